@@ -12,3 +12,11 @@ type Backend interface {
 	Create(string) (io.WriteCloser, error)
 	Walk(root string, walkFn filepath.WalkFunc) error
 }
+
+// Mutable is a Backend that can also rename and remove files, as needed to
+// edit a bag's payload
+type Mutable interface {
+	Backend
+	Rename(oldPath, newPath string) error // creates parent directories as needed
+	Remove(string) error
+}
@@ -8,7 +8,8 @@ import (
 
 // FS Implements Backend for the filesystem
 type FS struct {
-	Path string
+	Path   string
+	Policy WalkPolicy // which files Walk reports
 }
 
 func (be *FS) Stat(path string) (os.FileInfo, error) {
@@ -20,16 +21,48 @@ func (be *FS) Open(path string) (io.ReadCloser, error) {
 }
 
 func (be *FS) Create(path string) (io.WriteCloser, error) {
-	return os.Create(filepath.Join(be.Path, path))
+	fullPath := filepath.Join(be.Path, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(fullPath)
+}
+
+func (be *FS) Rename(oldPath, newPath string) error {
+	fullPath := filepath.Join(be.Path, newPath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(be.Path, oldPath), fullPath)
+}
+
+func (be *FS) Remove(path string) error {
+	return os.Remove(filepath.Join(be.Path, path))
 }
 
+// Walk calls f for each file under p, with paths relative to be.Path.
+// Directories are not reported. Symbolic links, hidden files and special
+// files are handled according to be.Policy.
 func (be *FS) Walk(p string, f filepath.WalkFunc) error {
-	wrapF := func(path string, fi os.FileInfo, err error) error {
-		if err != nil || !fi.Mode().IsRegular() {
-			return err
-		}
-		relPath, _ := filepath.Rel(be.Path, path)
-		return f(relPath, fi, err)
+	return be.walk(p, f, false)
+}
+
+// WalkAll is like Walk, but directories, including p, are also reported
+// before their contents. If f returns filepath.SkipDir for a directory, its
+// contents are skipped.
+func (be *FS) WalkAll(p string, f filepath.WalkFunc) error {
+	return be.walk(p, f, true)
+}
+
+func (be *FS) walk(p string, f filepath.WalkFunc, withDirs bool) error {
+	root := filepath.Join(be.Path, p)
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	w := &walker{base: be.Path, policy: be.Policy, walkFn: f, withDirs: withDirs}
+	if err = w.walk(root, info, true); err == filepath.SkipDir {
+		return nil
 	}
-	return filepath.Walk(filepath.Join(be.Path, p), wrapF)
+	return err
 }
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SymlinkPolicy determines how FS.Walk treats symbolic links
+type SymlinkPolicy int
+
+const (
+	SymlinkSkip     SymlinkPolicy = iota // leave out symbolic links (default)
+	SymlinkFollow                        // walk link targets, detecting cycles
+	SymlinkPreserve                      // report links to files without following them
+	SymlinkReject                        // return an error for symbolic links
+)
+
+// SpecialPolicy determines how FS.Walk treats special files, such as named
+// pipes, sockets and devices
+type SpecialPolicy int
+
+const (
+	SpecialSkip   SpecialPolicy = iota // leave out special files (default)
+	SpecialReject                      // return an error for special files
+)
+
+var symlinkNames = map[SymlinkPolicy]string{
+	SymlinkSkip:     `skip`,
+	SymlinkFollow:   `follow`,
+	SymlinkPreserve: `preserve`,
+	SymlinkReject:   `reject`,
+}
+
+var specialNames = map[SpecialPolicy]string{
+	SpecialSkip:   `skip`,
+	SpecialReject: `reject`,
+}
+
+func (p SymlinkPolicy) String() string { return symlinkNames[p] }
+func (p SpecialPolicy) String() string { return specialNames[p] }
+
+// ParseSymlinkPolicy returns the SymlinkPolicy with the given name
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	for p, n := range symlinkNames {
+		if n == strings.ToLower(name) {
+			return p, nil
+		}
+	}
+	return SymlinkSkip, fmt.Errorf("unknown symlink policy: %s", name)
+}
+
+// ParseSpecialPolicy returns the SpecialPolicy with the given name
+func ParseSpecialPolicy(name string) (SpecialPolicy, error) {
+	for p, n := range specialNames {
+		if n == strings.ToLower(name) {
+			return p, nil
+		}
+	}
+	return SpecialSkip, fmt.Errorf("unknown special file policy: %s", name)
+}
+
+// WalkPolicy determines which files FS.Walk reports. The zero value reports
+// regular files, including hidden files, and leaves out everything else.
+type WalkPolicy struct {
+	Symlinks   SymlinkPolicy
+	SkipHidden bool // leave out files and directories with names starting with '.'
+	Special    SpecialPolicy
+}
+
+// String returns the policy in the form parsed by ParseWalkPolicy, e.g.
+// "symlinks=follow hidden=skip special=reject"
+func (p WalkPolicy) String() string {
+	hidden := `include`
+	if p.SkipHidden {
+		hidden = `skip`
+	}
+	return fmt.Sprintf("symlinks=%s hidden=%s special=%s", p.Symlinks, hidden, p.Special)
+}
+
+// ParseWalkPolicy parses a WalkPolicy from the form returned by String.
+// Missing settings have default values.
+func ParseWalkPolicy(s string) (WalkPolicy, error) {
+	var p WalkPolicy
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, `=`, 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("invalid walk policy: %s", s)
+		}
+		var err error
+		switch strings.ToLower(kv[0]) {
+		case `symlinks`:
+			p.Symlinks, err = ParseSymlinkPolicy(kv[1])
+		case `hidden`:
+			switch strings.ToLower(kv[1]) {
+			case `skip`:
+				p.SkipHidden = true
+			case `include`:
+				p.SkipHidden = false
+			default:
+				err = fmt.Errorf("unknown hidden file policy: %s", kv[1])
+			}
+		case `special`:
+			p.Special, err = ParseSpecialPolicy(kv[1])
+		default:
+			err = fmt.Errorf("invalid walk policy: %s", s)
+		}
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// walker walks a directory tree according to a WalkPolicy
+type walker struct {
+	base   string
+	policy WalkPolicy
+	walkFn filepath.WalkFunc
+	dirs   []os.FileInfo // directories being walked, for cycle detection
+
+	withDirs bool // report directories as well as files
+}
+
+func (w *walker) walk(path string, info os.FileInfo, isRoot bool) error {
+	if w.policy.SkipHidden && !isRoot && strings.HasPrefix(info.Name(), `.`) {
+		return nil
+	}
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		switch w.policy.Symlinks {
+		case SymlinkReject:
+			return fmt.Errorf("symbolic link not allowed: %s", path)
+		case SymlinkPreserve:
+			target, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if target.IsDir() {
+				return fmt.Errorf("can't preserve symbolic link to directory: %s", path)
+			}
+			return w.file(path, info)
+		case SymlinkFollow:
+			target, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			return w.walk(path, target, isRoot)
+		}
+		return nil
+	case mode.IsDir():
+		for _, dir := range w.dirs {
+			if os.SameFile(dir, info) {
+				return fmt.Errorf("symbolic link cycle: %s", path)
+			}
+		}
+		if w.withDirs {
+			if err := w.file(path, info); err != nil {
+				if err == filepath.SkipDir {
+					return nil
+				}
+				return err
+			}
+		}
+		w.dirs = append(w.dirs, info)
+		defer func() { w.dirs = w.dirs[:len(w.dirs)-1] }()
+		dir, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := filepath.Join(path, name)
+			childInfo, err := os.Lstat(child)
+			if err != nil {
+				return err
+			}
+			if err = w.walk(child, childInfo, false); err != nil {
+				if err == filepath.SkipDir {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	case mode.IsRegular():
+		return w.file(path, info)
+	}
+	if w.policy.Special == SpecialReject {
+		return fmt.Errorf("special file not allowed: %s", path)
+	}
+	return nil
+}
+
+func (w *walker) file(path string, info os.FileInfo) error {
+	relPath, _ := filepath.Rel(w.base, path)
+	return w.walkFn(relPath, info, nil)
+}
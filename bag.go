@@ -19,18 +19,27 @@ const (
 	bagInfo        = `bag-info.txt`
 	fetchTxt       = `fetch.txt`
 	dataDir        = `data`
+	walkPolicyTag  = `Bago-Walk-Policy` // bag-info tag recording the payload walk policy
 )
 
 // Bag is a bagit repository
 type Bag struct {
-	backend.Backend             // backend interface (usually FSBag)
-	version         [2]int      // from bagit txt, major and minor ints
-	encoding        string      // from bagit.txt
-	payload         Payload     // contents of the data directory
-	Info            TagFile     // contents of bag-info.txt
-	manifests       []*Manifest // list of payload manifests
-	tagManifests    []*Manifest // list of tag file manifests
-	fetch           fetch       // contents of fetch.txt
+	backend.Backend              // backend interface (usually FSBag)
+	version         [2]int       // from bagit txt, major and minor ints
+	encoding        string       // from bagit.txt
+	payload         Payload      // contents of the data directory
+	Info            TagFile      // contents of bag-info.txt
+	manifests       []*Manifest  // list of payload manifests
+	tagManifests    []*Manifest  // list of tag file manifests
+	fetch           fetch        // contents of fetch.txt
+	stream          *streamState // set if the payload manifests aren't loaded
+
+	// StreamThreshold is the total size of the payload manifests, in bytes,
+	// above which Hydrate doesn't load them; see DefaultStreamThreshold,
+	// which is used if it is 0. If it is negative, they are always loaded.
+	StreamThreshold int64
+
+	fixedPolicy bool // don't apply the walk policy recorded in bag-info
 }
 
 type Payload map[NormPath]PayloadEntry
@@ -45,19 +54,33 @@ func (bag *Bag) Hydrate() error {
 	if bag.Backend == nil {
 		return errors.New("Cannot hydrate a bag with no Backend\n")
 	}
-	err := bag.readBagitTxt()
+	err := bag.finishCommit()
+	if err != nil {
+		return err
+	}
+	err = bag.readBagitTxt()
 	if err != nil {
 		return err
 	}
 	_ = bag.readBagInfo()
+	err = bag.applyWalkPolicy()
+	if err != nil {
+		return err
+	}
 	err = bag.readFetchFile()
 	if err != nil {
 		return err
 	}
-	err = bag.readPayload()
+	err = bag.checkStreaming()
 	if err != nil {
 		return err
 	}
+	if bag.stream == nil {
+		err = bag.readPayload()
+		if err != nil {
+			return err
+		}
+	}
 	err = bag.readAllManifests()
 	if err != nil {
 		return err
@@ -68,26 +91,46 @@ func (bag *Bag) Hydrate() error {
 // IsComplete returns whether bag satisfies bag completeness conditions.
 // See: https://tools.ietf.org/html/draft-kunze-bagit-16#section-3
 func (b *Bag) IsComplete() (bool, error) {
+	if b.stream != nil {
+		files, err := b.sortStream(``, b.stream.manifests)
+		if err != nil {
+			return false, err
+		}
+		defer files.close()
+		return b.isComplete(files, AllManifests)
+	}
+	return b.isComplete(nil, AllManifests)
+}
+
+// isComplete is IsComplete with the sorted files of a streamed bag and a
+// manifest policy
+func (b *Bag) isComplete(files *streamFiles, policy ManifestPolicy) (bool, error) {
 	if b.encoding == `` || !b.versionOk() {
 		return false, fmt.Errorf("Missing required fields in %s", bagitTxt)
 	}
-	if b.payload == nil {
-		return false, fmt.Errorf("bag has no payload")
-	}
-	if len(b.manifests) == 0 {
-		return false, fmt.Errorf("bag has no manifest")
-	}
-	missing := b.notInPayload()
-	if len(missing) > 0 {
-		msg := "Manifest files missing from payload:"
-		return false, fmt.Errorf("%s %s", msg, strings.Join(missing, "\n -"))
-	}
-	missing = b.notInManifests(0)
-	if len(missing) > 0 {
-		msg := "Payload files missing from manifest:"
-		return false, fmt.Errorf("%s %s", msg, strings.Join(missing, "\n -"))
+	if files != nil {
+		if err := b.streamComplete(files, policy); err != nil {
+			return false, err
+		}
+	} else {
+		if b.payload == nil {
+			return false, fmt.Errorf("bag has no payload")
+		}
+		if len(b.manifests) == 0 {
+			return false, fmt.Errorf("bag has no manifest")
+		}
+		missing := b.notInPayload()
+		if len(missing) > 0 {
+			msg := "Manifest files missing from payload:"
+			return false, fmt.Errorf("%s %s", msg, strings.Join(missing, "\n -"))
+		}
+		missing = b.notInManifests(policy)
+		if len(missing) > 0 {
+			msg := "Payload files missing from manifest:"
+			return false, fmt.Errorf("%s %s", msg, strings.Join(missing, "\n -"))
+		}
 	}
-	missing = b.missingTagFiles()
+	missing := b.missingTagFiles()
 	if len(missing) > 0 {
 		msg := "Tagfiles missing from tag manifests:"
 		return false, fmt.Errorf("%s %s", msg, strings.Join(missing, "\n -"))
@@ -95,13 +138,97 @@ func (b *Bag) IsComplete() (bool, error) {
 	return true, nil
 }
 
+// ValidateOptions is used to pass options to Validate()
+type ValidateOptions struct {
+	Workers     int
+	Cache       checksum.Cache       // optional checksum cache
+	CachePolicy checksum.CachePolicy // how Cache is used
+
+	RateLimit     int64 // max bytes read per second for checksums, if > 0
+	DeviceWorkers int   // max concurrent reads per storage device, if > 0
+
+	TempDir string // for sorting the manifests of streamed bags; defaults to os.TempDir()
+
+	// ManifestPolicy determines which payload manifests must list each
+	// payload file. The default, AllManifests, is required by BagIt.
+	ManifestPolicy ManifestPolicy
+
+	// RelativeTo says what the paths of the external manifest passed to
+	// VerifyAgainst are relative to. By default it is guessed.
+	RelativeTo RelativeTo
+}
+
+// ManifestPolicy determines which payload manifests must list each payload
+// file for a bag to be complete
+type ManifestPolicy int
+
+const (
+	AllManifests ManifestPolicy = iota // every payload manifest lists every file
+	AnyManifest                        // each file is listed in at least one payload manifest
+)
+
+func (p ManifestPolicy) String() string {
+	if p == AnyManifest {
+		return `any`
+	}
+	return `all`
+}
+
+// ParseManifestPolicy parses the name of a ManifestPolicy: all or any
+func ParseManifestPolicy(name string) (ManifestPolicy, error) {
+	switch strings.ToLower(name) {
+	case `all`:
+		return AllManifests, nil
+	case `any`:
+		return AnyManifest, nil
+	}
+	return 0, fmt.Errorf("unknown manifest policy: %s", name)
+}
+
+// satisfied returns whether a file listed in listing of total manifests
+// meets the policy
+func (p ManifestPolicy) satisfied(listing int, total int) bool {
+	if p == AnyManifest {
+		return listing > 0
+	}
+	return listing == total
+}
+
+func (opts *ValidateOptions) checksumOptions() []checksum.Option {
+	var ret []checksum.Option
+	if opts.Cache != nil {
+		ret = append(ret, checksum.WithCache(opts.Cache, opts.CachePolicy))
+	}
+	ret = append(ret, checksum.WithRateLimit(opts.RateLimit))
+	ret = append(ret, checksum.WithDeviceLimit(opts.DeviceWorkers))
+	return ret
+}
+
+// Validate returns an error if the bag is not valid. A valid bag is complete,
+// has no error Findings, and checksums listed in all manifests are correct.
+func (b *Bag) Validate(opts *ValidateOptions) error {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if b.stream != nil {
+		return b.validateStream(opts)
+	}
+	if _, err := b.isComplete(nil, opts.ManifestPolicy); err != nil {
+		return fmt.Errorf(`Bag is not complete: %s`, err.Error())
+	}
+	if err := b.Findings().Err(); err != nil {
+		return err
+	}
+	return b.validateManifests(opts)
+}
+
 // IsValid returns whether the bag at path is valid
 // A valid bag is complete and checksums listed in all manifests are correct.
 func (b *Bag) IsValidConcurrent(workers int) (bool, error) {
-	if _, err := b.IsComplete(); err != nil {
-		return false, fmt.Errorf(`Bag is not complete: %s`, err.Error())
-	}
-	if err := b.ValidateManifests(workers); err != nil {
+	if err := b.Validate(&ValidateOptions{Workers: workers}); err != nil {
 		return false, err
 	}
 	return true, nil
@@ -111,29 +238,75 @@ func (b *Bag) IsValid() (bool, error) {
 	return b.IsValidConcurrent(1)
 }
 
-func (b *Bag) ValidateManifests(workers int) (err error) {
-	checker := checksum.New(workers, b, func(push checksum.JobPusher) error {
-		for _, m := range append(b.manifests, b.tagManifests...) {
-			for _, entry := range m.entries {
-				j := checksum.Job{Path: entry.path, Alg: m.algorithm}
-				j.Expected = entry.sum
-				push(j)
-			}
+// ValidateManifests checks the checksums listed in all manifests. Files
+// listed in several manifests are read once.
+func (b *Bag) ValidateManifests(workers int) error {
+	return b.validateManifests(&ValidateOptions{Workers: workers})
+}
+
+func (b *Bag) validateManifests(opts *ValidateOptions) error {
+	if b.stream != nil {
+		files, err := b.sortStream(opts.TempDir, b.stream.manifests)
+		if err != nil {
+			return err
+		}
+		defer files.close()
+		if err = b.streamCheck(files, opts); err != nil {
+			return err
+		}
+	}
+	return b.checkManifestJobs(opts)
+}
+
+// checkManifestJobs verifies the checksums in the manifests loaded in memory
+func (b *Bag) checkManifestJobs(opts *ValidateOptions) (err error) {
+	checker := checksum.New(opts.Workers, b.Backend, func(push checksum.JobPusher) error {
+		for _, j := range b.manifestJobs() {
+			push(*j)
 		}
 		return nil
-	})
+	}, opts.checksumOptions()...)
 	for job := range checker.Results() {
 		if !job.SumIsExpected() {
 			if err == nil {
 				err = errors.New("checksum failed for: ")
 			}
-			err = fmt.Errorf("%s '%s'", err.Error(), job.Path)
+			if job.Err != nil {
+				err = fmt.Errorf("%s '%s' (%s)", err.Error(), job.Path, job.Err.Error())
+			} else {
+				err = fmt.Errorf("%s '%s'", err.Error(), job.Path)
+			}
 		}
 	}
-
+	if err == nil {
+		err = checker.Err()
+	}
 	return
 }
 
+// manifestJobs returns one checksum job for each file listed in the bag's
+// payload and tag manifests, with the expected sums from every manifest
+// that lists the file.
+func (b *Bag) manifestJobs() []*checksum.Job {
+	var jobs []*checksum.Job
+	byPath := map[NormPath]*checksum.Job{}
+	for _, m := range append(b.manifests, b.tagManifests...) {
+		for p, entry := range m.entries {
+			j, ok := byPath[p]
+			if !ok {
+				j = &checksum.Job{Path: entry.path, Expected: map[string][]byte{}}
+				byPath[p] = j
+				jobs = append(jobs, j)
+			}
+			if _, exists := j.Expected[m.algorithm]; !exists {
+				j.Algs = append(j.Algs, m.algorithm)
+			}
+			j.Expected[m.algorithm] = entry.sum
+		}
+	}
+	return jobs
+}
+
 // missingTagFiles scans tag manifest entries and reports missing tag files
 func (bag *Bag) missingTagFiles() []string {
 	missing := []string{}
@@ -161,19 +334,20 @@ func (b *Bag) notInPayload() []string {
 	return missing
 }
 
-// notInManifests scans payload for files not accounted for in manifests
-// thesh is the min number of manifests that a file can be missing from
-func (b *Bag) notInManifests(thresh int) []string {
-	counts := make(map[NormPath]int)
+// notInManifests scans payload for files not accounted for in manifests,
+// according to policy
+func (b *Bag) notInManifests(policy ManifestPolicy) []string {
 	missing := []string{}
 	for pPath := range b.payload {
+		listing := 0
 		for _, man := range b.manifests {
-			if _, ok := man.entries[pPath]; !ok {
-				if counts[pPath]++; counts[pPath] > thresh {
-					missing = append(missing, string(pPath))
-				}
+			if _, ok := man.entries[pPath]; ok {
+				listing++
 			}
 		}
+		if !policy.satisfied(listing, len(b.manifests)) {
+			missing = append(missing, string(pPath))
+		}
 	}
 	return missing
 }
@@ -188,6 +362,11 @@ func (bag *Bag) readPayload() error {
 			if _, exists := bag.payload[normPath]; exists {
 				return fmt.Errorf("path encoding collision: %s", path)
 			}
+			if info.Mode()&os.ModeSymlink != 0 { // preserved link
+				if info, err = bag.Stat(path); err != nil {
+					return err
+				}
+			}
 			bag.payload[normPath] = PayloadEntry{path: path, size: info.Size()}
 		}
 		return err
@@ -205,20 +384,24 @@ func (bag *Bag) readManifest(name string) (*Manifest, error) {
 
 // read and pars all manifests (both payload and tag manifests)
 func (bag *Bag) readAllManifests() error {
-	re := regexp.MustCompile(`(tag)?manifest-\w+.txt`)
-	return bag.Walk(``, func(p string, i os.FileInfo, e error) error {
-		if strings.HasPrefix(p, `data`+string(os.PathSeparator)) {
-			return filepath.SkipDir
-		}
+	re := regexp.MustCompile(`^(tag)?manifest-[\w-]+\.txt$`)
+	return bag.walkTags(func(p string, i os.FileInfo, e error) error {
 		if re.MatchString(p) {
+			if bag.stream != nil && !strings.HasPrefix(p, `tag`) {
+				if _, err := newManifestFromFilename(p); err != nil {
+					return err
+				}
+				bag.stream.manifests = append(bag.stream.manifests, p)
+				return e
+			}
 			man, err := bag.readManifest(p)
 			if err != nil {
 				return err
 			}
 			switch man.kind {
-			case payloadManifest:
+			case PayloadManifest:
 				bag.manifests = append(bag.manifests, man)
-			case tagManifest:
+			case TagManifest:
 				bag.tagManifests = append(bag.tagManifests, man)
 			}
 		}
@@ -226,6 +409,34 @@ func (bag *Bag) readAllManifests() error {
 	})
 }
 
+// walkTags walks the files outside the payload directory. The payload
+// directory itself is only walked if the backend can't report directories.
+func (bag *Bag) walkTags(fn filepath.WalkFunc) error {
+	type dirWalker interface {
+		WalkAll(string, filepath.WalkFunc) error
+	}
+	if be, ok := bag.Backend.(dirWalker); ok {
+		return be.WalkAll(``, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if p == dataDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return fn(p, info, nil)
+		})
+	}
+	return bag.Walk(``, func(p string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(p, dataDir+string(os.PathSeparator)) {
+			return filepath.SkipDir // the rest of this payload directory
+		}
+		return fn(p, info, err)
+	})
+}
+
 // read and parse bagit.txt
 func (bag *Bag) readBagitTxt() error {
 	var t TagFile
@@ -247,6 +458,25 @@ func (bag *Bag) readBagInfo() error {
 	return bag.parse(&bag.Info, bagInfo, bag.encoding)
 }
 
+// applyWalkPolicy sets the walk policy of a filesystem backend to the one
+// recorded in bag-info.txt, if any.
+func (bag *Bag) applyWalkPolicy() error {
+	fs, ok := bag.Backend.(*backend.FS)
+	if !ok || bag.fixedPolicy {
+		return nil
+	}
+	val, exists := bag.Info.Value(walkPolicyTag)
+	if !exists {
+		return nil
+	}
+	policy, err := backend.ParseWalkPolicy(val)
+	if err != nil {
+		return fmt.Errorf("%s: %s", bagInfo, err.Error())
+	}
+	fs.Policy = policy
+	return nil
+}
+
 // read and parse fetch.txt
 func (bag *Bag) readFetchFile() error {
 	_, err := bag.Stat(fetchTxt)
@@ -296,6 +526,28 @@ func (bag *Bag) versionOk() bool {
 	return true
 }
 
+// Manifests returns the bag's payload manifests. The manifests of a
+// streamed bag are read into memory on each call; the bag stays streamed.
+func (bag *Bag) Manifests() ([]*Manifest, error) {
+	if bag.stream != nil {
+		var mans []*Manifest
+		for _, name := range bag.stream.manifests {
+			man, err := bag.readManifest(name)
+			if err != nil {
+				return nil, err
+			}
+			mans = append(mans, man)
+		}
+		return mans, nil
+	}
+	return append([]*Manifest(nil), bag.manifests...), nil
+}
+
+// TagManifests returns the bag's tag manifests
+func (bag *Bag) TagManifests() []*Manifest {
+	return append([]*Manifest(nil), bag.tagManifests...)
+}
+
 func (bag *Bag) WritePayloadManifests() error {
 	for _, man := range bag.manifests {
 		if err := bag.write(man.Filename(), man); err != nil {
@@ -307,7 +559,7 @@ func (bag *Bag) WritePayloadManifests() error {
 
 func (bag *Bag) WriteTagManifests() error {
 	for _, man := range bag.tagManifests {
-		man.kind = tagManifest
+		man.kind = TagManifest
 		if err := bag.write(man.Filename(), man); err != nil {
 			return err
 		}
@@ -316,7 +568,11 @@ func (bag *Bag) WriteTagManifests() error {
 }
 
 func (bag *Bag) WriteBagitTxt() error {
-	return bag.write(bagitTxt, DefaultBagitTxt())
+	bagit := DefaultBagitTxt()
+	if bag.encoding != `` {
+		bagit.Set(`Tag-File-Character-Encoding`, bag.encoding)
+	}
+	return bag.write(bagitTxt, bagit)
 }
 
 func (bag *Bag) WriteBagInfo() error {
@@ -332,7 +588,8 @@ func (bag *Bag) write(path string, writer bagComponent) (err error) {
 	if file, err = bag.Create(path); err != nil {
 		return err
 	}
-	if err = writer.Write(file); err != nil {
+	if err = bag.encode(file, path, writer); err != nil {
+		file.Close()
 		return err
 	}
 	if err = file.Close(); err != nil {
@@ -340,3 +597,25 @@ func (bag *Bag) write(path string, writer bagComponent) (err error) {
 	}
 	return nil
 }
+
+// encode writes the tag file name to w, encoded with the bag's tag file
+// character encoding
+func (bag *Bag) encode(w io.Writer, name string, writer bagComponent) error {
+	enc, err := newEncodeWriter(w, bag.tagEncoding(name))
+	if err != nil {
+		return err
+	}
+	if err = writer.Write(enc); err != nil {
+		return fmt.Errorf("While writing %s: %s", name, err.Error())
+	}
+	return enc.Close()
+}
+
+// tagEncoding returns the character encoding of the tag file name.
+// bagit.txt and the metadata tag file are always UTF-8.
+func (bag *Bag) tagEncoding(name string) string {
+	if bag.encoding == `` || name == bagitTxt || name == metadataTxt {
+		return `UTF-8`
+	}
+	return bag.encoding
+}
@@ -1,8 +1,8 @@
 package bago
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,119 +17,422 @@ type CreateBagOptions struct {
 	SrcDir     string
 	DstPath    string
 	InPlace    bool
+	Mode       CreateMode // how SrcDir is transferred to the bag
 	Algorithms []string
 	Info       TagFile
 	Workers    int
+
+	// Payload selection. Sources are added to the payload along with SrcDir,
+	// which may be empty if Sources are given. Include and Exclude are
+	// gitignore-style patterns matched against paths relative to data/.
+	Sources []PayloadSource
+	Files   []string // if set, only these paths (relative to SrcDir) are included
+	Include []string // if set, only matching files are included
+	Exclude []string // matching files are left out
+
+	// WalkPolicy determines how symbolic links, hidden files and special
+	// files in source directories are handled. It is recorded in bag-info
+	// so the bag is validated with the same policy.
+	WalkPolicy backend.WalkPolicy
+
+	// PreserveMetadata adds a tag file recording the modification times,
+	// permissions and owners of payload files and directories, which can be
+	// reapplied with RestoreMetadata.
+	PreserveMetadata bool
+
+	// Encoding is the Tag-File-Character-Encoding for the bag's tag files,
+	// given by IANA name (e.g. ISO-8859-1 or UTF-16). Defaults to UTF-8.
+	Encoding string
+
+	// Date is used for the Bagging-Date tag. If zero, the current date is used.
+	// Generated tags that are already set in Info are not replaced, so
+	// bags created from the same content and options are identical.
+	Date time.Time
+
+	// TrustedSums are checksums supplied with the payload, for example
+	// from ReadChecksums. Paths are relative to the bag if they all start
+	// with data/, otherwise relative to data/. Listed files are verified
+	// against them when the payload manifests are computed, and bag
+	// creation fails if one doesn't match, isn't in the payload or has
+	// conflicting sums.
+	TrustedSums []*Manifest
+
+	Cache       checksum.Cache       // optional checksum cache
+	CachePolicy checksum.CachePolicy // how Cache is used
+
+	RateLimit     int64 // max bytes read per second for checksums, if > 0
+	DeviceWorkers int   // max concurrent reads per storage device, if > 0
+}
+
+func (opts *CreateBagOptions) checksumOptions() []checksum.Option {
+	var ret []checksum.Option
+	if opts.Cache != nil {
+		ret = append(ret, checksum.WithCache(opts.Cache, opts.CachePolicy))
+	}
+	ret = append(ret, checksum.WithRateLimit(opts.RateLimit))
+	ret = append(ret, checksum.WithDeviceLimit(opts.DeviceWorkers))
+	return ret
 }
 
+// OpenBag opens the bag at path. The payload is read using the walk policy
+// recorded in bag-info, if any.
 func OpenBag(path string) (*Bag, error) {
 	bag := &Bag{Backend: &backend.FS{Path: path}}
 	return bag, bag.Hydrate()
 }
 
-// Create Bag Creates a new Bag with FSBag backend
+// OpenBagWithPolicy opens the bag at path, reading the payload using policy
+// instead of the walk policy recorded in bag-info.
+func OpenBagWithPolicy(path string, policy backend.WalkPolicy) (*Bag, error) {
+	bag := &Bag{Backend: &backend.FS{Path: path, Policy: policy}, fixedPolicy: true}
+	return bag, bag.Hydrate()
+}
+
+// Create Bag Creates a new Bag with FSBag backend. Progress is journaled in
+// the build directory: if bag creation is interrupted, calling CreateBag
+// again with the same SrcDir and DstPath resumes it using the options it
+// was started with, and RecoverBag rolls it back.
 func CreateBag(opts *CreateBagOptions) (bag *Bag, err error) {
-	var buildDir string
 	if opts.Workers < 1 {
 		opts.Workers = 1
 	}
+	if opts.InPlace && opts.Mode != MoveMode {
+		err = fmt.Errorf("in-place bag creation requires %s mode", MoveMode)
+		return
+	}
+
+	if opts.SrcDir == `` && (opts.InPlace || opts.DstPath == ``) {
+		err = fmt.Errorf("bag creation without SrcDir requires DstPath")
+		return
+	}
+
 	// set path options to absolute paths
 	for _, p := range [2]*string{&opts.SrcDir, &opts.DstPath} {
+		if *p == `` && p == &opts.SrcDir {
+			continue
+		}
 		if *p, err = filepath.Abs(*p); err != nil {
 			err = fmt.Errorf("could not determine absolute path for %s", *p)
 			return
 		}
 	}
-	//DstPath can't be a subdir of SrcDir
-	var rel string
-	if rel, err = filepath.Rel(opts.SrcDir, opts.DstPath); err != nil {
+	//DstPath can't be a subdir of a source
+	srcPaths := []string{opts.SrcDir}
+	for _, source := range opts.Sources {
+		srcPaths = append(srcPaths, source.Path)
+	}
+	for _, src := range srcPaths {
+		if src == `` {
+			continue
+		}
+		var rel string
+		if src, err = filepath.Abs(src); err != nil {
+			return
+		}
+		if rel, err = filepath.Rel(src, opts.DstPath); err != nil {
+			return
+		}
+		if !strings.HasPrefix(rel, `..`) {
+			err = fmt.Errorf("%s is a subdirectory of %s", opts.DstPath, src)
+			return
+		}
+	}
+
+	// resume interrupted bag creation
+	var state *createState
+	if opts.InPlace {
+		state, err = findCreateState(inPlaceBuildDir(opts.SrcDir), opts.SrcDir)
+	} else if opts.SrcDir == `` {
+		state, err = findCreateState(opts.DstPath)
+	} else {
+		subDir := filepath.Join(opts.DstPath, filepath.Base(opts.SrcDir))
+		state, err = findCreateState(opts.DstPath, subDir)
+	}
+	if err != nil {
 		return
 	}
-	if !strings.HasPrefix(rel, `..`) {
-		err = fmt.Errorf("%s is a subdirectory of %s", opts.DstPath, opts.SrcDir)
+	if state != nil && state.SrcDir != opts.SrcDir {
+		err = fmt.Errorf("%s has an interrupted bag creation for %s", state.BuildDir, state.SrcDir)
 		return
 	}
+	if state == nil {
+		if state, err = newCreateState(opts); err != nil {
+			return
+		}
+	}
+	return state.run(opts)
+}
 
+// newCreateState prepares the build directory for a new bag and saves the
+// initial journal.
+func newCreateState(opts *CreateBagOptions) (state *createState, err error) {
+	state = &createState{
+		SrcDir:     opts.SrcDir,
+		DstPath:    opts.DstPath,
+		InPlace:    opts.InPlace,
+		Mode:       opts.Mode,
+		Algorithms: make([]string, len(opts.Algorithms)),
+		Metadata:   opts.PreserveMetadata,
+		Encoding:   opts.Encoding,
+	}
+	if len(opts.Algorithms) == 0 {
+		return nil, fmt.Errorf("Can't make manifest without an algorithm")
+	}
+	if state.Encoding == `` {
+		state.Encoding = `UTF-8`
+	}
+	if _, err := lookupEncoding(state.Encoding); err != nil {
+		return nil, err
+	}
+	for i := range opts.Algorithms {
+		alg, err := checksum.NormalizeAlgName(opts.Algorithms[i])
+		if err != nil {
+			return nil, err
+		}
+		state.Algorithms[i] = alg
+	}
+	if state.Plan, err = PlanPayload(opts); err != nil {
+		return nil, err
+	}
+	if opts.InPlace && !state.Plan.Whole {
+		return nil, fmt.Errorf("in-place bag creation can't select payload files or leave out files skipped by the walk policy")
+	}
+	if opts.Mode == MoveMode {
+		srcs := map[string]bool{}
+		for _, entry := range state.Plan.Entries {
+			if srcs[entry.Src] {
+				return nil, fmt.Errorf("%s can't be moved to the payload more than once", entry.Src)
+			}
+			srcs[entry.Src] = true
+		}
+	}
 	if opts.InPlace { // Prepare in-place bag creation
-		opts.DstPath = opts.SrcDir
-		baseDir := filepath.Dir(opts.DstPath)
-		dirName := filepath.Base(opts.SrcDir)
-		if buildDir, err = ioutil.TempDir(baseDir, dirName); err != nil {
-			return
+		state.DstPath = opts.SrcDir
+		state.BuildDir = inPlaceBuildDir(opts.SrcDir)
+		if err = os.Mkdir(state.BuildDir, 0755); err != nil {
+			return nil, err
 		}
 	} else { // Prepare bag to new destination
 		var dstInfo os.FileInfo
 		if dstInfo, err = os.Stat(opts.DstPath); err != nil {
 			// If dstPath doesn't exist, try to create it
 			if !os.IsNotExist(err) {
-				return
+				return nil, err
 			}
 			if err = os.Mkdir(opts.DstPath, 0755); err != nil {
-				return
+				return nil, err
 			}
 		} else {
 			// If dstPath exists, treat as parent dir for new bag
 			if !dstInfo.IsDir() {
-				err = fmt.Errorf("expected a directory: %s", opts.DstPath)
-				return
+				return nil, fmt.Errorf("expected a directory: %s", opts.DstPath)
 			}
-			opts.DstPath = filepath.Join(opts.DstPath, filepath.Base(opts.SrcDir))
-			if err = os.Mkdir(opts.DstPath, 0755); err != nil {
-				return
+			if opts.SrcDir == `` {
+				return nil, fmt.Errorf("destination already exists: %s", opts.DstPath)
+			}
+			state.DstPath = filepath.Join(opts.DstPath, filepath.Base(opts.SrcDir))
+			if err = os.Mkdir(state.DstPath, 0755); err != nil {
+				return nil, err
 			}
 		}
-		buildDir = opts.DstPath
+		state.BuildDir = state.DstPath
 	}
 	defer func() {
 		if err != nil {
-			os.RemoveAll(buildDir)
+			os.RemoveAll(state.BuildDir)
+		}
+	}()
+
+	// generated tags are fixed when bag creation starts
+	bag := &Bag{Info: opts.Info.copy()}
+	date := opts.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	bag.setGeneratedTag(BaggingDateTag, date.Format("2006-01-02"))
+	bag.setGeneratedTag(`Bag-Software-Agent`, `bago`)
+	bag.Info.Set(walkPolicyTag, opts.WalkPolicy.String())
+	bag.Info.Set(PayloadOxumTag, fmt.Sprintf("%d.%d", state.Plan.TotalSize, len(state.Plan.Entries)))
+	var info strings.Builder
+	if err = bag.Info.Write(&info); err != nil {
+		return nil, err
+	}
+	state.Info = info.String()
+	state.path = filepath.Join(state.BuildDir, createJournal)
+	return state, state.advance(phaseStarted)
+}
+
+// run completes the remaining phases of bag creation
+func (s *createState) run(opts *CreateBagOptions) (bag *Bag, err error) {
+	if s.Phase >= phasePayload {
+		return s.finalize()
+	}
+	dataPath := filepath.Join(s.BuildDir, dataDir)
+	// Once files have been moved into the bag, the build directory is kept
+	// if there is an error, so that it can be resumed or recovered.
+	moved := s.Mode == MoveMode && exists(dataPath) &&
+		(!s.Plan.Whole || !exists(s.SrcDir))
+	defer func() {
+		if err != nil && !moved && s.Phase < phasePayload {
+			os.RemoveAll(s.BuildDir)
 		}
 	}()
 
 	// tmp Bag
 	bag = &Bag{
-		Backend:  &backend.FS{Path: buildDir},
-		Info:     opts.Info,
-		encoding: `UTF-8`,
+		Backend:  &backend.FS{Path: s.BuildDir},
+		encoding: s.Encoding,
 		version:  [...]int{0, 97},
 	}
-	bag.manifests, err = ManfifestsForDir(opts.SrcDir, opts.Algorithms, opts.Workers, `data/`)
-	if err != nil {
+	if err = bag.Info.parse(strings.NewReader(s.Info)); err != nil {
 		return nil, err
 	}
-	if err = bag.WritePayloadManifests(); err != nil {
-		return nil, err
+	if s.Phase < phaseTagFiles {
+		if err = bag.WriteBagitTxt(); err != nil {
+			return nil, err
+		}
+		if err = bag.WriteBagInfo(); err != nil {
+			return nil, err
+		}
+		if s.Metadata {
+			// sources are recorded before they are transferred
+			metas, err := planMetadata(s.Plan)
+			if err != nil {
+				return nil, err
+			}
+			if err = bag.write(metadataTxt, metadataList(metas)); err != nil {
+				return nil, err
+			}
+		}
+		if err = s.advance(phaseTagFiles); err != nil {
+			return nil, err
+		}
 	}
-	if err = bag.WriteBagitTxt(); err != nil {
-		return nil, err
+	if s.Phase < phaseManifests {
+		if err = s.writePayloadManifests(bag, opts); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, alg := range s.Algorithms {
+			man, err := bag.readManifest(fmt.Sprintf("manifest-%s.txt", alg))
+			if err != nil {
+				return nil, err
+			}
+			bag.manifests = append(bag.manifests, man)
+		}
+	}
+	if s.Phase < phaseTagManifests {
+		bag.tagManifests, err = dirManifests(s.BuildDir, s.Algorithms, opts.Workers, ``, isJournalFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = bag.WriteTagManifests(); err != nil {
+			return nil, err
+		}
+		if err = s.advance(phaseTagManifests); err != nil {
+			return nil, err
+		}
+	}
+	var copied bool
+	if !s.Plan.Whole {
+		moved = s.Mode == MoveMode
+		if copied, err = transferPlan(s.Plan, dataPath, s.Mode); err != nil {
+			return nil, err
+		}
+	} else if !moved {
+		if err = os.RemoveAll(dataPath); err != nil { // interrupted copy
+			return nil, err
+		}
+		copied, err = transferPayload(s.SrcDir, dataPath, s.Mode)
+		moved = s.Mode == MoveMode && !copied && err == nil
+		if err != nil {
+			return nil, err
+		}
 	}
-	bag.Info.Set(`Bag-Date`, time.Now().Format("2006-01-02"))
-	bag.Info.Set(`Bag-Software-Agent`, `bago`)
-	if err = bag.WriteBagInfo(); err != nil {
+	if copied {
+		// verify copies against the manifests computed from the source
+		bag.tagManifests = nil
+		verifyOpts := &ValidateOptions{
+			Workers:       opts.Workers,
+			RateLimit:     opts.RateLimit,
+			DeviceWorkers: opts.DeviceWorkers,
+		}
+		if err = bag.validateManifests(verifyOpts); err != nil {
+			return nil, fmt.Errorf("verifying copied payload: %s", err.Error())
+		}
+	}
+	s.Copied = copied && s.Mode == MoveMode
+	if err = s.advance(phasePayload); err != nil {
 		return nil, err
 	}
-	bag.tagManifests, err = ManfifestsForDir(buildDir, opts.Algorithms, opts.Workers, ``)
+	return s.finalize()
+}
+
+// writePayloadManifests computes and writes the payload manifests. Computed
+// checksums are cached in the build directory so they can be reused if bag
+// creation is interrupted.
+func (s *createState) writePayloadManifests(bag *Bag, opts *CreateBagOptions) (err error) {
+	sumOpts := opts.checksumOptions()
+	if opts.Cache == nil {
+		var cache *checksum.FileCache
+		cache, err = checksum.OpenFileCache(filepath.Join(s.BuildDir, createChecksum))
+		if err != nil {
+			return err
+		}
+		defer cache.Close()
+		sumOpts = append(sumOpts, checksum.WithCache(cache, checksum.TrustCache))
+	}
+	bag.manifests, err = planManifests(s.Plan, s.Algorithms, opts.TrustedSums, opts.Workers, sumOpts...)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err = bag.WriteTagManifests(); err != nil {
-		return nil, err
+	if err = bag.WritePayloadManifests(); err != nil {
+		return err
 	}
-	if err = os.Rename(opts.SrcDir, filepath.Join(buildDir, `data`)); err != nil {
-		return nil, err
+	return s.advance(phaseManifests)
+}
+
+// finalize moves an in-place bag into place, removes the journal, and
+// returns the new bag.
+func (s *createState) finalize() (*Bag, error) {
+	if s.Mode == MoveMode && s.Copied && !s.InPlace {
+		var err error
+		if s.Plan.Whole {
+			err = os.RemoveAll(s.SrcDir)
+		} else {
+			err = s.Plan.removeSources()
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	if opts.InPlace {
-		if err = os.Rename(buildDir, opts.DstPath); err != nil {
+	if s.InPlace && exists(s.BuildDir) {
+		if err := os.Rename(s.BuildDir, s.DstPath); err != nil {
 			return nil, err
 		}
 	}
-	bag, err = OpenBag(opts.DstPath)
-	return
+	if err := s.finish(s.DstPath); err != nil {
+		return nil, err
+	}
+	return OpenBag(s.DstPath)
+}
+
+// setGeneratedTag sets a bag-info tag unless it has already been set
+func (bag *Bag) setGeneratedTag(label string, value string) {
+	if !bag.Info.Has(label) {
+		bag.Info.Set(label, value)
+	}
 }
 
 // Manifests for Dir returns a slice of manifests describing contents of a
-// directory.
-func ManfifestsForDir(dPath string, algs []string, numWorkers int, prefix string) ([]*Manifest, error) {
+// directory. Options are passed to the checksum.Checksumer.
+func ManfifestsForDir(dPath string, algs []string, numWorkers int, prefix string, opts ...checksum.Option) ([]*Manifest, error) {
+	return dirManifests(dPath, algs, numWorkers, prefix, nil, opts...)
+}
+
+// dirManifests is ManfifestsForDir with a filter: files in dPath for which
+// skip returns true are left out of the manifests.
+func dirManifests(dPath string, algs []string, numWorkers int, prefix string, skip func(string) bool, opts ...checksum.Option) ([]*Manifest, error) {
 	if len(algs) == 0 {
 		return nil, fmt.Errorf("Can't make manifest without an algorithm")
 	}
@@ -140,24 +443,111 @@ func ManfifestsForDir(dPath string, algs []string, numWorkers int, prefix string
 		}
 	}
 	fs := &backend.FS{Path: dPath}
-	mans := map[string]*Manifest{}
 	sumer := checksum.New(numWorkers, fs, func(push checksum.JobPusher) error {
 		return fs.Walk(`.`, func(p string, fi os.FileInfo, err error) error {
-			for _, alg := range algs {
-				push(checksum.Job{Path: p, Alg: alg, Err: err})
+			if skip != nil && skip(p) {
+				return err
 			}
+			push(checksum.Job{Path: p, Algs: algs, Err: err})
 			return err
 		})
-	})
-	for check := range sumer.Results() {
-		_, ok := mans[check.Alg]
-		if !ok {
-			mans[check.Alg] = &Manifest{algorithm: check.Alg}
+	}, opts...)
+	return collectManifests(sumer, algs, func(p string) []string { return []string{prefix + p} })
+}
+
+// planManifests returns payload manifests for the files in plan. Files
+// listed in trusted are verified against it.
+func planManifests(plan *PayloadPlan, algs []string, trusted []*Manifest, numWorkers int, opts ...checksum.Option) ([]*Manifest, error) {
+	// a source file may be included more than once
+	var srcs []string
+	dsts := make(map[string][]string, len(plan.Entries))
+	jobs := map[string]*checksum.Job{}
+	byDst := map[NormPath]*checksum.Job{}
+	for _, entry := range plan.Entries {
+		job, exists := jobs[entry.Src]
+		if !exists {
+			srcs = append(srcs, entry.Src)
+			job = &checksum.Job{Path: entry.Src, Algs: algs}
+			jobs[entry.Src] = job
+		}
+		dsts[entry.Src] = append(dsts[entry.Src], dataDir+`/`+entry.Dst)
+		byDst[EncodePath(entry.Dst).Norm()] = job
+	}
+	for _, man := range trusted {
+		bagRelative := man.bagRelative()
+		for norm, entry := range man.entries {
+			if bagRelative {
+				norm = NormPath(strings.TrimPrefix(string(norm), dataDir+`/`))
+			}
+			job, exists := byDst[norm]
+			if !exists {
+				return nil, fmt.Errorf("trusted checksum for a file not in the payload: %s", entry.path)
+			}
+			if job.Expected == nil {
+				job.Expected = map[string][]byte{}
+				job.Algs = append([]string(nil), algs...)
+			}
+			found := false
+			for _, alg := range job.Algs {
+				found = found || alg == man.algorithm
+			}
+			if !found { // trusted algorithm that isn't used for the bag
+				job.Algs = append(job.Algs, man.algorithm)
+			}
+			if sum, exists := job.Expected[man.algorithm]; exists && !bytes.Equal(sum, entry.sum) {
+				return nil, fmt.Errorf("conflicting trusted %s checksums for: %s", man.algorithm, entry.path)
+			}
+			job.Expected[man.algorithm] = entry.sum
 		}
-		err := mans[check.Alg].Append(EncodePath(prefix+check.Path), check.Sum)
+	}
+	// sources are absolute paths
+	sumer := checksum.New(numWorkers, &backend.FS{}, func(push checksum.JobPusher) error {
+		for _, src := range srcs {
+			push(*jobs[src])
+		}
+		return nil
+	}, opts...)
+	return collectManifests(sumer, algs, func(p string) []string { return dsts[p] })
+}
+
+// collectManifests returns a manifest for each algorithm from the results
+// of sumer. names returns the manifest paths for a job's path.
+func collectManifests(sumer *checksum.Checksumer, algs []string, names func(string) []string) ([]*Manifest, error) {
+	mans := map[string]*Manifest{}
+	for _, alg := range algs {
+		mans[alg] = &Manifest{algorithm: alg}
+	}
+	var err error
+	for check := range sumer.Results() {
 		if err != nil {
-			return nil, err
+			continue // drain remaining results
 		}
+		if err = check.Err; err != nil {
+			sumer.Cancel()
+			continue
+		}
+		if mismatches := check.Mismatches(); len(mismatches) > 0 {
+			err = fmt.Errorf("checksum failed for: '%s' (%s)", check.Path, strings.Join(mismatches, `, `))
+			sumer.Cancel()
+			continue
+		}
+		for _, name := range names(check.Path) {
+			for _, alg := range algs {
+				if err = mans[alg].Append(EncodePath(name), check.Sums[alg]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				sumer.Cancel()
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = sumer.Err()
+	}
+	if err != nil {
+		return nil, err
 	}
 	ret := make([]*Manifest, len(algs))
 	for i, alg := range algs {
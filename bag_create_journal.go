@@ -0,0 +1,183 @@
+package bago
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	createJournal  = `.bago-create.json` // state of an unfinished CreateBag
+	createChecksum = `.bago-checksums`   // checksum cache for CreateBag
+)
+
+// createPhase is a step in bag creation. Phases are completed in order.
+type createPhase int
+
+const (
+	phaseStarted      createPhase = iota // build directory created
+	phaseTagFiles                        // bagit.txt, bag-info.txt and metadata written
+	phaseManifests                       // payload manifests written
+	phaseTagManifests                    // tag manifests written
+	phasePayload                         // payload transferred and verified
+)
+
+// createState is the journal for CreateBag. It is saved in the build
+// directory after each phase so that interrupted bag creation can be resumed
+// by calling CreateBag again, or rolled back with RecoverBag.
+type createState struct {
+	Phase      createPhase  `json:"phase"`
+	SrcDir     string       `json:"src_dir"`
+	DstPath    string       `json:"dst_path"`
+	BuildDir   string       `json:"build_dir"`
+	InPlace    bool         `json:"in_place"`
+	Mode       CreateMode   `json:"mode"`
+	Algorithms []string     `json:"algorithms"`
+	Plan       *PayloadPlan `json:"plan"`
+	Info       string       `json:"info"`     // contents of bag-info.txt
+	Metadata   bool         `json:"metadata"` // write the metadata tag file
+	Encoding   string       `json:"encoding"` // tag file character encoding
+	Copied     bool         `json:"copied"`   // payload was copied in move mode
+
+	path string // location of the journal file
+}
+
+// createPhaseHook, if set, is called after each phase is saved. It is used
+// by tests to simulate interruptions.
+var createPhaseHook func(createPhase)
+
+// inPlaceBuildDir returns the build directory used to bag srcDir in place
+func inPlaceBuildDir(srcDir string) string {
+	return filepath.Join(filepath.Dir(srcDir), `.`+filepath.Base(srcDir)+`.bago`)
+}
+
+// loadCreateState reads the journal in dir. It returns nil if there is none.
+func loadCreateState(dir string) (*createState, error) {
+	path := filepath.Join(dir, createJournal)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s := &createState{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("reading %s: %s", path, err.Error())
+	}
+	s.path = path
+	return s, nil
+}
+
+// findCreateState looks for the journal of an interrupted CreateBag in each
+// of dirs.
+func findCreateState(dirs ...string) (*createState, error) {
+	for _, dir := range dirs {
+		s, err := loadCreateState(dir)
+		if s != nil || err != nil {
+			return s, err
+		}
+	}
+	return nil, nil
+}
+
+// advance records that phase has been completed
+func (s *createState) advance(phase createPhase) error {
+	s.Phase = phase
+	data, err := json.MarshalIndent(s, ``, `  `)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + `.tmp`
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if createPhaseHook != nil {
+		createPhaseHook(phase)
+	}
+	return nil
+}
+
+// finish removes journal files from the completed bag at dir
+func (s *createState) finish(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if !isJournalFile(info.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isJournalFile returns true for files used to track bag creation,
+// including the temporary files they are saved through, which are left
+// behind if bag creation is interrupted while they are written
+func isJournalFile(name string) bool {
+	return name == createJournal || name == createJournal+`.tmp` ||
+		strings.HasPrefix(name, createChecksum)
+}
+
+// RecoverBag rolls back an interrupted CreateBag. The partially built bag
+// is removed and, if files were moved into it, the source directory is
+// restored. path is the source directory of an in-place bag, or the build
+// directory of a bag created at a new destination.
+func RecoverBag(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	s, err := findCreateState(inPlaceBuildDir(path), path)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("no interrupted bag creation found for %s", path)
+	}
+	if s.path != filepath.Join(s.BuildDir, createJournal) {
+		// the in-place bag was renamed to the source path: move it back
+		if err := os.Rename(filepath.Dir(s.path), s.BuildDir); err != nil {
+			return err
+		}
+	}
+	dataPath := filepath.Join(s.BuildDir, dataDir)
+	if s.Mode == MoveMode && !s.Plan.Whole {
+		if err := s.Plan.restoreSources(dataPath); err != nil {
+			return err
+		}
+	} else if s.Mode == MoveMode && exists(dataPath) {
+		srcExists := exists(s.SrcDir)
+		if srcExists && s.Copied && s.Phase >= phasePayload {
+			// The source may have been partially removed after it was
+			// copied and verified. Replace it with the copy.
+			if err := os.RemoveAll(s.SrcDir); err != nil {
+				return err
+			}
+			srcExists = false
+		}
+		if !srcExists {
+			if _, err := transferPayload(dataPath, s.SrcDir, MoveMode); err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(s.BuildDir)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,110 @@
+package bago
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+type interrupt createPhase
+
+// createInterrupted runs CreateBag, simulating a crash after phase
+func createInterrupted(t *testing.T, opts *CreateBagOptions, phase createPhase) {
+	createPhaseHook = func(p createPhase) {
+		if p == phase {
+			panic(interrupt(p))
+		}
+	}
+	defer func() {
+		createPhaseHook = nil
+		if r := recover(); r == nil {
+			t.Fatal("expected CreateBag to be interrupted")
+		} else if _, ok := r.(interrupt); !ok {
+			panic(r)
+		}
+	}()
+	CreateBag(opts)
+}
+
+func TestCreateBagResume(t *testing.T) {
+	fileContent := map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	}
+	for _, phase := range []createPhase{phaseStarted, phaseManifests, phasePayload} {
+		p := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(p)
+		defer os.RemoveAll(inPlaceBuildDir(p))
+		opts := &CreateBagOptions{
+			SrcDir:     p,
+			InPlace:    true,
+			Algorithms: []string{`md5`},
+		}
+		createInterrupted(t, opts, phase)
+		// temporary files left by interrupted journal and cache writes
+		leftovers := []string{createJournal + `.tmp`, createChecksum + `123456`}
+		for _, name := range leftovers {
+			if err := ioutil.WriteFile(filepath.Join(inPlaceBuildDir(p), name), []byte(`partial`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bag, err := CreateBag(&CreateBagOptions{SrcDir: p, InPlace: true})
+		if err != nil {
+			t.Fatalf("resuming after phase %d: %s", phase, err)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("resuming after phase %d: %s", phase, err)
+		}
+		for _, name := range leftovers {
+			if _, listed := bag.tagManifests[0].entries[NormPath(name)]; listed {
+				t.Errorf("resuming after phase %d: %s is in the tag manifest", phase, name)
+			}
+		}
+		for _, name := range append(leftovers, createJournal, createChecksum) {
+			if exists(filepath.Join(p, name)) {
+				t.Errorf("resuming after phase %d: %s was not removed", phase, name)
+			}
+		}
+		if exists(inPlaceBuildDir(p)) {
+			t.Errorf("resuming after phase %d: build directory was not removed", phase)
+		}
+	}
+}
+
+func TestRecoverBag(t *testing.T) {
+	fileContent := map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	}
+	for _, phase := range []createPhase{phaseManifests, phasePayload} {
+		p := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(p)
+		defer os.RemoveAll(inPlaceBuildDir(p))
+		opts := &CreateBagOptions{
+			SrcDir:     p,
+			InPlace:    true,
+			Algorithms: []string{`md5`},
+		}
+		createInterrupted(t, opts, phase)
+		if err := RecoverBag(p); err != nil {
+			t.Fatalf("recovering after phase %d: %s", phase, err)
+		}
+		if exists(inPlaceBuildDir(p)) {
+			t.Errorf("recovering after phase %d: build directory was not removed", phase)
+		}
+		for name, content := range fileContent {
+			got, err := ioutil.ReadFile(filepath.Join(p, filepath.FromSlash(name)))
+			if err != nil || string(got) != string(content) {
+				t.Errorf("recovering after phase %d: %s was not restored", phase, name)
+			}
+		}
+	}
+	p := test.TmpDataPath(nil)
+	defer os.RemoveAll(p)
+	if err := RecoverBag(p); err == nil {
+		t.Error("expected an error recovering a directory that isn't being bagged")
+	}
+}
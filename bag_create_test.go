@@ -1,10 +1,17 @@
 package bago
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/srerickson/bago/backend"
 	"github.com/srerickson/bago/test"
 )
 
@@ -32,3 +39,491 @@ func TestCreateBag(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestCreateBagReproducible(t *testing.T) {
+	fileContent := map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+		`dir1/file3.txt`: []byte(`this is file 3`),
+		`file4.txt`:      []byte(`this is file 4`),
+	}
+	date := time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+	var bagPaths []string
+	for i := 0; i < 2; i++ {
+		p := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(p)
+		opts := &CreateBagOptions{
+			SrcDir:     p,
+			InPlace:    true,
+			Algorithms: []string{`sha512`, `md5`},
+			Workers:    runtime.GOMAXPROCS(0),
+			Date:       date,
+		}
+		if _, err := CreateBag(opts); err != nil {
+			t.Fatal(err)
+		}
+		bagPaths = append(bagPaths, p)
+	}
+	for _, name := range []string{`manifest-md5.txt`, `bag-info.txt`, `tagmanifest-sha512.txt`} {
+		var contents [2][]byte
+		for i, p := range bagPaths {
+			var err error
+			if contents[i], err = ioutil.ReadFile(filepath.Join(p, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(contents[0], contents[1]) {
+			t.Errorf("expected %s to be identical in both bags", name)
+		}
+	}
+}
+
+func TestCreateBagModes(t *testing.T) {
+	fileContent := map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	}
+	for _, mode := range []CreateMode{CopyMode, LinkMode, ReflinkMode} {
+		src := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir(``, `testBagDst`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		opts := &CreateBagOptions{
+			SrcDir:     src,
+			DstPath:    filepath.Join(dst, `bag`),
+			Mode:       mode,
+			Algorithms: []string{`md5`},
+		}
+		bag, err := CreateBag(opts)
+		if err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("%s: %s", mode, err)
+		}
+		srcInfo, err := os.Stat(filepath.Join(src, `dir1`, `file2.txt`))
+		if err != nil {
+			t.Fatalf("%s: expected source to be intact: %s", mode, err)
+		}
+		dstInfo, err := os.Stat(filepath.Join(dst, `bag`, `data`, `dir1`, `file2.txt`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked := os.SameFile(srcInfo, dstInfo); linked != (mode == LinkMode) {
+			t.Errorf("%s: unexpected hard link state: %v", mode, linked)
+		}
+	}
+	if _, err := CreateBag(&CreateBagOptions{
+		SrcDir:     `.`,
+		InPlace:    true,
+		Mode:       CopyMode,
+		Algorithms: []string{`md5`},
+	}); err == nil {
+		t.Error("expected an error for in-place bag creation in copy mode")
+	}
+}
+
+func TestCreateBagLinkFallback(t *testing.T) {
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: `link`, Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	defer func() { linkFile = os.Link }()
+	// the whole source directory, and a plan that leaves a file out
+	for _, exclude := range [][]string{nil, {`skip.txt`}} {
+		src := test.TmpDataPath(map[string][]byte{
+			`file1.txt`:      []byte(`this is file 1`),
+			`dir1/file2.txt`: []byte(`this is file 2`),
+			`skip.txt`:       []byte(`skipped`),
+		})
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir(``, `testBagDst`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		bag, err := CreateBag(&CreateBagOptions{
+			SrcDir:     src,
+			DstPath:    filepath.Join(dst, `bag`),
+			Mode:       LinkMode,
+			Algorithms: []string{`md5`},
+			Exclude:    exclude,
+		})
+		if err != nil {
+			t.Fatalf("exclude %v: expected files to be copied: %s", exclude, err)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("exclude %v: %s", exclude, err)
+		}
+		srcInfo, err := os.Stat(filepath.Join(src, `dir1`, `file2.txt`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dstInfo, err := os.Stat(filepath.Join(dst, `bag`, `data`, `dir1`, `file2.txt`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(srcInfo, dstInfo) {
+			t.Errorf("exclude %v: expected a copy, not a link", exclude)
+		}
+	}
+}
+
+func TestCreateBagWalkPolicy(t *testing.T) {
+	fileContent := map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`.hidden`:        []byte(`hidden file`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	}
+	outside := test.TmpDataPath(map[string][]byte{`target.txt`: []byte(`link target`)})
+	defer os.RemoveAll(outside)
+	newSrc := func() string {
+		src := test.TmpDataPath(fileContent)
+		err := os.Symlink(filepath.Join(outside, `target.txt`), filepath.Join(src, `link.txt`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+	table := map[string]struct {
+		policy  backend.WalkPolicy
+		present []string
+		absent  []string
+		err     bool
+	}{
+		`default`:  {present: []string{`.hidden`}, absent: []string{`link.txt`}},
+		`follow`:   {policy: backend.WalkPolicy{Symlinks: backend.SymlinkFollow}, present: []string{`link.txt`}},
+		`preserve`: {policy: backend.WalkPolicy{Symlinks: backend.SymlinkPreserve}, present: []string{`link.txt`}},
+		`reject`:   {policy: backend.WalkPolicy{Symlinks: backend.SymlinkReject}, err: true},
+		`hidden`:   {policy: backend.WalkPolicy{SkipHidden: true}, absent: []string{`.hidden`, `link.txt`}},
+	}
+	for name, tcase := range table {
+		src := newSrc()
+		defer os.RemoveAll(src)
+		dst, err := ioutil.TempDir(``, `testBagDst`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+		bag, err := CreateBag(&CreateBagOptions{
+			SrcDir:     src,
+			DstPath:    filepath.Join(dst, `bag`),
+			Mode:       CopyMode,
+			Algorithms: []string{`md5`},
+			WalkPolicy: tcase.policy,
+		})
+		if tcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if got := bag.Info.Get(walkPolicyTag); len(got) != 1 || got[0] != tcase.policy.String() {
+			t.Errorf("%s: expected %s tag, got %v", name, walkPolicyTag, got)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+		for _, p := range tcase.present {
+			if _, exists := bag.payload[EncodePath(`data/`+p).Norm()]; !exists {
+				t.Errorf("%s: expected %s in payload", name, p)
+			}
+		}
+		for _, p := range tcase.absent {
+			if _, exists := bag.payload[EncodePath(`data/`+p).Norm()]; exists {
+				t.Errorf("%s: expected %s not to be in payload", name, p)
+			}
+		}
+		info, err := os.Lstat(filepath.Join(dst, `bag`, `data`, `link.txt`))
+		if isLink := err == nil && info.Mode()&os.ModeSymlink != 0; isLink != (name == `preserve`) {
+			t.Errorf("%s: unexpected symlink state in payload: %v", name, isLink)
+		}
+		if name == `preserve` {
+			// without the recorded policy, the preserved link isn't payload
+			bag, err = OpenBagWithPolicy(filepath.Join(dst, `bag`), backend.WalkPolicy{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bag.IsComplete(); err == nil {
+				t.Error("expected bag read without its walk policy to be incomplete")
+			}
+		}
+	}
+}
+
+func TestCreateBagMoveFollowedLink(t *testing.T) {
+	outside := test.TmpDataPath(map[string][]byte{`target.txt`: []byte(`link target`)})
+	defer os.RemoveAll(outside)
+	src := test.TmpDataPath(map[string][]byte{`file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	link := filepath.Join(src, `link.txt`)
+	if err := os.Symlink(filepath.Join(outside, `target.txt`), link); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir(``, `testBagDst`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:     src,
+		DstPath:    filepath.Join(dst, `bag`),
+		Algorithms: []string{`md5`},
+		WalkPolicy: backend.WalkPolicy{Symlinks: backend.SymlinkFollow},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, `file1.txt`)); !os.IsNotExist(err) {
+		t.Error("expected file1.txt to be moved")
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the followed link to be left in place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, `target.txt`)); err != nil {
+		t.Errorf("expected the link target to be left in place: %s", err)
+	}
+}
+
+func TestCreateBagInPlaceWalkPolicy(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/.hidden`:   []byte(`hidden file`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	})
+	defer os.RemoveAll(src)
+	opts := &CreateBagOptions{
+		SrcDir:     src,
+		InPlace:    true,
+		Algorithms: []string{`md5`},
+		WalkPolicy: backend.WalkPolicy{SkipHidden: true},
+	}
+	// moving the directory would put the hidden file in the payload
+	if _, err := CreateBag(opts); err == nil {
+		t.Fatal("expected an error creating a bag in place that leaves out a hidden file")
+	}
+	if _, err := os.Stat(filepath.Join(src, `dir1`, `.hidden`)); err != nil {
+		t.Fatal(err)
+	}
+	if exists(inPlaceBuildDir(src)) {
+		t.Error("expected the build directory to be removed")
+	}
+	if err := os.Remove(filepath.Join(src, `dir1`, `.hidden`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateBag(opts); err != nil {
+		t.Fatal(err)
+	}
+	bag, err := OpenBagWithPolicy(src, backend.WalkPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bag.Validate(nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWalkPolicyCycle(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`dir1/file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	if err := os.Symlink(`..`, filepath.Join(src, `dir1`, `parent`)); err != nil {
+		t.Fatal(err)
+	}
+	fs := &backend.FS{Path: src, Policy: backend.WalkPolicy{Symlinks: backend.SymlinkFollow}}
+	err := fs.Walk(`.`, func(string, os.FileInfo, error) error { return nil })
+	if err == nil {
+		t.Error("expected an error for a symbolic link cycle")
+	}
+	policy, err := backend.ParseWalkPolicy(fs.Policy.String())
+	if err != nil || policy != fs.Policy {
+		t.Errorf("walk policy didn't round trip: %v, %s", policy, err)
+	}
+}
+
+func TestCreateBagMetadata(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	})
+	defer os.RemoveAll(src)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := os.Mkdir(filepath.Join(src, `empty`), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, `file1.txt`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{`file1.txt`, `empty`} {
+		if err := os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := ioutil.TempDir(``, `testBagDst`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	bagPath := filepath.Join(dst, `bag`)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:           src,
+		DstPath:          bagPath,
+		Mode:             CopyMode,
+		Algorithms:       []string{`md5`},
+		Exclude:          []string{`dir1/`},
+		PreserveMetadata: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+	if _, exists := bag.tagManifests[0].entries[EncodePath(metadataTxt).Norm()]; !exists {
+		t.Errorf("expected %s in tag manifest", metadataTxt)
+	}
+	metas, err := bag.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, meta := range metas {
+		paths = append(paths, meta.Path)
+	}
+	if got := strings.Join(paths, ` `); got != `data data/empty data/file1.txt` {
+		t.Errorf("unexpected metadata paths: %s", got)
+	}
+
+	// restore to an extracted copy of the payload
+	extracted := filepath.Join(dst, `extracted`)
+	if err := os.Mkdir(extracted, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(bagPath, `data`, `file1.txt`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(extracted, `file1.txt`), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.RestoreMetadata(&RestoreOptions{Dir: extracted}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{`file1.txt`, `empty`} {
+		info, err := os.Stat(filepath.Join(extracted, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: expected mtime %s, got %s", p, mtime, info.ModTime())
+		}
+	}
+	info, err := os.Stat(filepath.Join(extracted, `file1.txt`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %s", info.Mode())
+	}
+
+	// restore in place, with the default options
+	bagFile := filepath.Join(bagPath, `data`, `file1.txt`)
+	now := time.Now()
+	if err := os.Chtimes(bagFile, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.RestoreMetadata(nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(bagFile); err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("expected mtime %s, got %s", mtime, info.ModTime())
+	}
+}
+
+func TestCreateBagEncoding(t *testing.T) {
+	fileContent := map[string][]byte{
+		`café.txt`: []byte(`coffee`),
+	}
+	for enc, prefix := range map[string][]byte{
+		`ISO-8859-1`: []byte("Contact-Name: Jos\xe9"),
+		`UTF-16`:     {0xff, 0xfe, 'C', 0},
+	} {
+		p := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(p)
+		info := TagFile{}
+		info.Append(ContactNameTag, `José`)
+		bag, err := CreateBag(&CreateBagOptions{
+			SrcDir:     p,
+			InPlace:    true,
+			Algorithms: []string{`md5`},
+			Info:       info,
+			Encoding:   enc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("%s: %s", enc, err)
+		}
+		if bag.encoding != enc {
+			t.Errorf("expected encoding %s, got %s", enc, bag.encoding)
+		}
+		if name, _ := bag.Info.Value(ContactNameTag); name != `José` {
+			t.Errorf("%s: expected Contact-Name José, got %s", enc, name)
+		}
+		if man := bag.manifests[0]; man.entries[EncodePath(`data/café.txt`).Norm()].path == `` {
+			t.Errorf("%s: expected manifest entry for data/café.txt", enc)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(p, bagInfo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, prefix) {
+			t.Errorf("%s: unexpected bag-info.txt: %q", enc, data)
+		}
+		// edits are written in the same encoding
+		bag.Info.Set(ContactNameTag, `Zoë`)
+		if err := bag.SaveTags(); err != nil {
+			t.Fatal(err)
+		}
+		if bag, err = OpenBag(p); err != nil {
+			t.Fatal(err)
+		}
+		if name, _ := bag.Info.Value(ContactNameTag); name != `Zoë` {
+			t.Errorf("%s: expected Contact-Name Zoë, got %s", enc, name)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("%s: %s", enc, err)
+		}
+	}
+
+	// characters that can't be represented are an error
+	p := test.TmpDataPath(fileContent)
+	defer os.RemoveAll(p)
+	info := TagFile{}
+	info.Append(ContactNameTag, `☃`)
+	opts := &CreateBagOptions{
+		SrcDir:     p,
+		InPlace:    true,
+		Algorithms: []string{`md5`},
+		Info:       info,
+		Encoding:   `ISO-8859-1`,
+	}
+	if _, err := CreateBag(opts); err == nil {
+		t.Error("expected an error for a character not in ISO-8859-1")
+	}
+	opts.Encoding = `no-such-encoding`
+	if _, err := CreateBag(opts); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+}
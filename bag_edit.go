@@ -0,0 +1,757 @@
+package bago
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/srerickson/bago/backend"
+	"github.com/srerickson/bago/checksum"
+)
+
+const (
+	stagedSuffix  = `.bago-tmp`         // added to files staged by payload edits
+	commitJournal = `.bago-commit.json` // renames and removals of an unfinished commit
+)
+
+// payloadEdit is a change to a bag's payload. New payload files are staged
+// under temporary names before the edit is committed.
+type payloadEdit struct {
+	renames [][2]string // payload files to rename, from and to
+	removes []string    // payload files to remove
+
+	hasMetas bool         // the bag has a metadata tag file
+	metas    metadataList // updated contents of the metadata tag file
+
+	tagFiles   map[string]bagComponent // other tag files to write, by name
+	rehashTags bool                    // recompute tag manifest entries for unmodeled tag files
+	keep       bool                    // keep changes in memory if the commit fails
+}
+
+// newPayloadEdit returns an edit for the bag, loading its metadata
+func (bag *Bag) newPayloadEdit() (*payloadEdit, error) {
+	metas, err := bag.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	return &payloadEdit{hasMetas: metas != nil, metas: metas}, nil
+}
+
+// payloadName returns the path in the bag of the slash-separated path p,
+// relative to data/
+func payloadName(p string) (string, error) {
+	p = filepath.ToSlash(p)
+	for _, part := range strings.Split(p, `/`) {
+		if part == `..` {
+			return ``, fmt.Errorf("invalid payload path: %s", p)
+		}
+	}
+	p = strings.Trim(path.Clean(`/`+p), `/`)
+	if p == `` {
+		return ``, fmt.Errorf("invalid payload path: %s", p)
+	}
+	return dataDir + `/` + p, nil
+}
+
+// errReadOnly is returned by payload edits if the bag's backend can't rename
+// and remove files
+var errReadOnly = errors.New("backend is read-only")
+
+// mutable returns the bag's backend if it implements backend.Mutable
+func (bag *Bag) mutable() (backend.Mutable, error) {
+	fs, ok := bag.Backend.(backend.Mutable)
+	if !ok {
+		return nil, errReadOnly
+	}
+	return fs, nil
+}
+
+// discard removes the file name from the bag, if its backend allows it,
+// ignoring errors
+func (bag *Bag) discard(name string) {
+	if fs, ok := bag.Backend.(backend.Mutable); ok {
+		fs.Remove(name)
+	}
+}
+
+// stagedName returns the temporary name used to stage the file name
+func stagedName(name string) string {
+	return path.Join(path.Dir(name), `.`+path.Base(name)+stagedSuffix)
+}
+
+// AddPayload copies the file src into the payload at dstPath, a
+// slash-separated path relative to data/. The payload manifests,
+// Payload-Oxum, metadata and tag manifests are updated.
+func (bag *Bag) AddPayload(src string, dstPath string) (err error) {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	name, err := payloadName(dstPath)
+	if err != nil {
+		return err
+	}
+	norm := EncodePath(name).Norm()
+	if _, exists := bag.payload[norm]; exists {
+		return fmt.Errorf("%s is already in the payload", name)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", src)
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	staged := stagedName(name)
+	sums, err := bag.copyIn(src, staged)
+	if err != nil {
+		bag.discard(staged)
+		return err
+	}
+	for _, man := range bag.manifests {
+		man.entries[norm] = ManifestEntry{path: name, sum: sums[man.algorithm]}
+	}
+	bag.payload[norm] = PayloadEntry{path: name, size: info.Size()}
+	if edit.hasMetas {
+		edit.metas = append(edit.metas, newFileMetadata(strings.TrimPrefix(name, dataDir+`/`), info))
+	}
+	edit.renames = append(edit.renames, [2]string{staged, name})
+	if err = bag.commit(edit); err != nil {
+		bag.discard(staged)
+	}
+	return err
+}
+
+// RemovePayload removes the file at p, a slash-separated path relative to
+// data/, from the payload. The payload manifests, Payload-Oxum, metadata
+// and tag manifests are updated.
+func (bag *Bag) RemovePayload(p string) error {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	name, err := payloadName(p)
+	if err != nil {
+		return err
+	}
+	norm := EncodePath(name).Norm()
+	entry, inPayload := bag.payload[norm]
+	inManifests := false
+	for _, man := range bag.manifests {
+		if _, exists := man.entries[norm]; exists {
+			inManifests = true
+		}
+	}
+	if !inPayload && !inManifests {
+		return fmt.Errorf("%s is not in the payload", name)
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	for _, man := range bag.manifests {
+		delete(man.entries, norm)
+	}
+	if inPayload {
+		delete(bag.payload, norm)
+		edit.removes = append(edit.removes, entry.path)
+	}
+	edit.metas = edit.metas.without(name)
+	return bag.commit(edit)
+}
+
+// RenamePayload moves the payload file at oldPath to newPath, both
+// slash-separated paths relative to data/. The payload manifests, metadata
+// and tag manifests are updated.
+func (bag *Bag) RenamePayload(oldPath string, newPath string) error {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	oldName, err := payloadName(oldPath)
+	if err != nil {
+		return err
+	}
+	newName, err := payloadName(newPath)
+	if err != nil {
+		return err
+	}
+	oldNorm, newNorm := EncodePath(oldName).Norm(), EncodePath(newName).Norm()
+	entry, exists := bag.payload[oldNorm]
+	if !exists {
+		return fmt.Errorf("%s is not in the payload", oldName)
+	}
+	if _, exists := bag.payload[newNorm]; exists {
+		return fmt.Errorf("%s is already in the payload", newName)
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	for _, man := range bag.manifests {
+		if manEntry, exists := man.entries[oldNorm]; exists {
+			delete(man.entries, oldNorm)
+			man.entries[newNorm] = ManifestEntry{path: newName, sum: manEntry.sum}
+		}
+	}
+	delete(bag.payload, oldNorm)
+	bag.payload[newNorm] = PayloadEntry{path: newName, size: entry.size}
+	for i := range edit.metas {
+		if edit.metas[i].Path == oldName {
+			edit.metas[i].Path = newName
+		}
+	}
+	edit.renames = append(edit.renames, [2]string{entry.path, newName})
+	return bag.commit(edit)
+}
+
+// copyIn copies the file src to name in the bag, returning its checksums
+// for each payload manifest algorithm.
+func (bag *Bag) copyIn(src string, name string) (map[string][]byte, error) {
+	if _, err := bag.mutable(); err != nil {
+		return nil, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := bag.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	writers := []io.Writer{out}
+	hashes := map[string]hash.Hash{}
+	for _, man := range bag.manifests {
+		h, err := checksum.NewHash(man.algorithm)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		hashes[man.algorithm] = h
+		writers = append(writers, h)
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), in); err != nil {
+		out.Close()
+		return nil, err
+	}
+	if err = out.Close(); err != nil {
+		return nil, err
+	}
+	sums := map[string][]byte{}
+	for alg, h := range hashes {
+		sums[alg] = h.Sum(nil)
+	}
+	return sums, nil
+}
+
+// stagedFile is a tag file written by commit
+type stagedFile struct {
+	name string
+	data []byte
+}
+
+// commit writes the bag's payload manifests, bag-info.txt and metadata
+// after a payload edit, and updates the tag manifests to match. The tag
+// files are staged under temporary names and the renames and removals
+// that complete the edit are recorded in a journal, so that an interrupted
+// commit is finished when the bag is next hydrated. Then the edit's payload
+// files are renamed, the tag files are renamed into place and removed
+// payload files are deleted. If there is an error, the bag is re-read from
+// its backend unless edit.keep is set.
+func (bag *Bag) commit(edit *payloadEdit) (err error) {
+	defer func() {
+		if err != nil && !edit.keep {
+			bag.reload()
+		}
+	}()
+	fs, err := bag.mutable()
+	if err != nil {
+		return err
+	}
+	if bag.Info.Has(PayloadOxumTag) {
+		bag.Info.Set(PayloadOxumTag, bag.payload.oxum())
+	}
+	var staged []stagedFile
+	render := func(name string, c bagComponent) error {
+		var buf bytes.Buffer
+		if err := bag.encode(&buf, name, c); err != nil {
+			return err
+		}
+		staged = append(staged, stagedFile{name: name, data: buf.Bytes()})
+		return nil
+	}
+	for _, man := range bag.manifests {
+		if err = render(man.Filename(), man); err != nil {
+			return err
+		}
+	}
+	if err = render(bagInfo, &bag.Info); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(edit.tagFiles))
+	for name := range edit.tagFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = render(name, edit.tagFiles[name]); err != nil {
+			return err
+		}
+	}
+	if edit.hasMetas {
+		sort.Slice(edit.metas, func(i, j int) bool {
+			return edit.metas[i].Path < edit.metas[j].Path
+		})
+		if err = render(metadataTxt, edit.metas); err != nil {
+			return err
+		}
+	}
+	if err = bag.updateTagManifests(staged); err != nil {
+		return err
+	}
+	if edit.rehashTags {
+		if err = bag.rehashTagFiles(staged); err != nil {
+			return err
+		}
+	}
+	for _, man := range bag.tagManifests {
+		if err = render(man.Filename(), man); err != nil {
+			return err
+		}
+	}
+
+	// stage tag files
+	var journal *commitState
+	defer func() {
+		if journal != nil {
+			return // staged files are renamed when the journal is replayed
+		}
+		for _, f := range staged {
+			fs.Remove(stagedName(f.name))
+		}
+	}()
+	for _, f := range staged {
+		var out io.WriteCloser
+		if out, err = bag.Create(stagedName(f.name)); err != nil {
+			return err
+		}
+		if _, err = out.Write(f.data); err != nil {
+			out.Close()
+			return err
+		}
+		if err = out.Close(); err != nil {
+			return err
+		}
+	}
+	state := &commitState{Renames: edit.renames, Removes: edit.removes}
+	for _, f := range staged {
+		state.Renames = append(state.Renames, [2]string{stagedName(f.name), f.name})
+	}
+	if err = state.save(fs); err != nil {
+		return err
+	}
+	journal = state
+	if commitHook != nil {
+		if err = commitHook(); err != nil {
+			return err
+		}
+	}
+	return journal.apply(fs)
+}
+
+// commitHook, if set, is called after a commit's journal is saved. It is
+// used by tests to simulate interruptions.
+var commitHook func() error
+
+// commitState is the journal of a commit: the renames and removals that
+// complete it, once its files have been staged
+type commitState struct {
+	Renames [][2]string `json:"renames"` // from and to
+	Removes []string    `json:"removes"`
+}
+
+// save writes s to the journal in fs
+func (s *commitState) save(fs backend.Mutable) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := commitJournal + `.tmp`
+	out, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(data); err != nil {
+		out.Close()
+		fs.Remove(tmp)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+	return fs.Rename(tmp, commitJournal)
+}
+
+// apply completes the commit and removes its journal. Renames and removals
+// that were already done are skipped, so it can be called again if it is
+// interrupted.
+func (s *commitState) apply(fs backend.Mutable) error {
+	for _, r := range s.Renames {
+		if _, err := fs.Stat(r[0]); err != nil {
+			if _, done := fs.Stat(r[1]); done == nil {
+				continue
+			}
+			return err
+		}
+		if err := fs.Rename(r[0], r[1]); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.Removes {
+		if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return fs.Remove(commitJournal)
+}
+
+// finishCommit completes a commit that was interrupted after its journal
+// was saved. A journal that wasn't completely saved, and the files staged
+// for it, are left for the commit's caller to clean up.
+func (bag *Bag) finishCommit() error {
+	reader, err := bag.Open(commitJournal)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var s commitState
+	err = json.NewDecoder(reader).Decode(&s)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %s", commitJournal, err.Error())
+	}
+	fs, err := bag.mutable()
+	if err != nil {
+		return fmt.Errorf("can't finish the commit in %s: %s", commitJournal, err.Error())
+	}
+	return s.apply(fs)
+}
+
+// updateTagManifests sets the tag manifest entries for the tag files in
+// staged, computing checksums from their contents
+func (bag *Bag) updateTagManifests(staged []stagedFile) error {
+	for _, man := range bag.tagManifests {
+		for _, f := range staged {
+			h, err := checksum.NewHash(man.algorithm)
+			if err != nil {
+				return err
+			}
+			h.Write(f.data)
+			if man.entries == nil {
+				man.entries = map[NormPath]ManifestEntry{}
+			}
+			man.entries[EncodePath(f.name).Norm()] = ManifestEntry{path: f.name, sum: h.Sum(nil)}
+		}
+	}
+	return nil
+}
+
+// rehashTagFiles recomputes the tag manifest entries for tag files other
+// than those in staged and the tag manifests themselves
+func (bag *Bag) rehashTagFiles(staged []stagedFile) error {
+	skip := map[NormPath]bool{}
+	for _, f := range staged {
+		skip[EncodePath(f.name).Norm()] = true
+	}
+	for _, man := range bag.tagManifests {
+		skip[EncodePath(man.Filename()).Norm()] = true
+	}
+	for _, man := range bag.tagManifests {
+		for norm, entry := range man.entries {
+			if skip[norm] {
+				continue
+			}
+			h, err := checksum.NewHash(man.algorithm)
+			if err != nil {
+				return err
+			}
+			reader, err := bag.Open(entry.path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			man.entries[norm] = ManifestEntry{path: entry.path, sum: h.Sum(nil)}
+		}
+	}
+	return nil
+}
+
+// SaveTags writes bag-info.txt, the payload manifests and the metadata tag
+// file, and recomputes the tag manifests for every algorithm present,
+// including entries for other tag files that have been changed. Use it
+// after changing Info.
+func (bag *Bag) SaveTags() error {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	edit.rehashTags = true
+	edit.keep = true
+	return bag.commit(edit)
+}
+
+// ConvertEncoding rewrites bagit.txt, bag-info.txt, the manifests and
+// fetch.txt in the character encoding enc, given by IANA name, and updates
+// the tag manifests. The tag files are checked against the tag manifests
+// first. Nothing is written if a tag file has a character that can't be
+// represented in enc.
+func (bag *Bag) ConvertEncoding(enc string) (err error) {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	if _, err = lookupEncoding(enc); err != nil {
+		return err
+	}
+	var bagit TagFile
+	if err = bag.parse(&bagit, bagitTxt, `UTF-8`); err != nil {
+		return err
+	}
+	bagit.Set(`Tag-File-Character-Encoding`, enc)
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	edit.tagFiles = map[string]bagComponent{bagitTxt: &bagit}
+	if _, err := bag.Stat(fetchTxt); err == nil {
+		edit.tagFiles[fetchTxt] = bag.fetch
+	}
+	rewritten := map[NormPath]bool{}
+	for _, name := range []string{bagitTxt, bagInfo, fetchTxt} {
+		rewritten[EncodePath(name).Norm()] = true
+	}
+	for _, man := range append(bag.manifests, bag.tagManifests...) {
+		rewritten[EncodePath(man.Filename()).Norm()] = true
+	}
+	if err = bag.checkTagFiles(rewritten); err != nil {
+		return err
+	}
+	bag.encoding = enc
+	return bag.commit(edit)
+}
+
+// checkTagFiles returns an error if the tag files in names don't match the
+// tag manifests
+func (bag *Bag) checkTagFiles(names map[NormPath]bool) error {
+	for _, man := range bag.tagManifests {
+		for norm, entry := range man.entries {
+			if !names[norm] {
+				continue
+			}
+			h, err := checksum.NewHash(man.algorithm)
+			if err != nil {
+				return err
+			}
+			reader, err := bag.Open(entry.path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(h, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(h.Sum(nil), entry.sum) {
+				return fmt.Errorf("checksum failed for: '%s'", entry.path)
+			}
+		}
+	}
+	return nil
+}
+
+// reload re-reads the bag from its backend, discarding changes in memory
+func (bag *Bag) reload() error {
+	*bag = Bag{Backend: bag.Backend, StreamThreshold: bag.StreamThreshold, fixedPolicy: bag.fixedPolicy}
+	return bag.Hydrate()
+}
+
+// oxum returns the Payload-Oxum value for the payload: its size in octets
+// and number of files
+func (payload Payload) oxum() string {
+	size, count := payload.totals()
+	return fmt.Sprintf("%d.%d", size, count)
+}
+
+// totals returns the total size and number of files in the payload
+func (payload Payload) totals() (size int64, count int64) {
+	for _, entry := range payload {
+		size += entry.size
+	}
+	return size, int64(len(payload))
+}
+
+// without returns metas without the entry for name
+func (metas metadataList) without(name string) metadataList {
+	ret := metas[:0]
+	for _, meta := range metas {
+		if meta.Path != name {
+			ret = append(ret, meta)
+		}
+	}
+	return ret
+}
+
+// AddManifest adds payload and tag manifests for the algorithm alg. The bag
+// is verified against its existing manifests, and the new checksums are
+// computed in the same pass, so the new manifests are only written if the
+// bag is valid.
+func (bag *Bag) AddManifest(alg string, opts *ValidateOptions) (err error) {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	if alg, err = checksum.NormalizeAlgName(alg); err != nil {
+		return err
+	}
+	for _, man := range append(bag.manifests, bag.tagManifests...) {
+		if man.algorithm == alg {
+			return fmt.Errorf("bag already has %s", man.Filename())
+		}
+	}
+	if _, err = bag.IsComplete(); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	jobs := bag.manifestJobs()
+	// tag files that aren't in a tag manifest are hashed too
+	listed := map[NormPath]bool{}
+	for _, j := range jobs {
+		listed[EncodePath(j.Path).Norm()] = true
+	}
+	tagRE := regexp.MustCompile(`^tagmanifest-[\w-]+\.txt$`)
+	err = bag.Walk(``, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p = filepath.ToSlash(p)
+		if strings.HasPrefix(p, dataDir+`/`) || tagRE.MatchString(p) || listed[EncodePath(p).Norm()] {
+			return nil
+		}
+		jobs = append(jobs, &checksum.Job{Path: p, Expected: map[string][]byte{}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	checker := checksum.New(opts.Workers, bag.Backend, func(push checksum.JobPusher) error {
+		for _, j := range jobs {
+			job := *j
+			job.Algs = append(append([]string{}, j.Algs...), alg)
+			push(job)
+		}
+		return nil
+	}, opts.checksumOptions()...)
+	payloadMan := &Manifest{algorithm: alg, kind: PayloadManifest}
+	tagMan := &Manifest{algorithm: alg, kind: TagManifest}
+	for job := range checker.Results() {
+		if err != nil {
+			continue // drain remaining results
+		}
+		if job.Err != nil || !job.SumIsExpected() {
+			err = fmt.Errorf("checksum failed for: '%s'", job.Path)
+			if job.Err != nil {
+				err = fmt.Errorf("%s (%s)", err.Error(), job.Err.Error())
+			}
+			checker.Cancel()
+			continue
+		}
+		man := tagMan
+		if _, exists := bag.payload[EncodePath(job.Path).Norm()]; exists {
+			man = payloadMan
+		}
+		if err = man.Append(EncodePath(job.Path), job.Sums[alg]); err != nil {
+			checker.Cancel()
+		}
+	}
+	if err == nil {
+		err = checker.Err()
+	}
+	if err != nil {
+		return err
+	}
+	bag.manifests = append(bag.manifests, payloadMan)
+	bag.tagManifests = append(bag.tagManifests, tagMan)
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	return bag.commit(edit)
+}
+
+// RemoveManifest removes the payload and tag manifests for the algorithm
+// alg. The last payload manifest can't be removed.
+func (bag *Bag) RemoveManifest(alg string) (err error) {
+	if err := bag.loadPayload(); err != nil {
+		return err
+	}
+	if alg, err = checksum.NormalizeAlgName(alg); err != nil {
+		return err
+	}
+	var manifests []*Manifest
+	for _, man := range bag.manifests {
+		if man.algorithm != alg {
+			manifests = append(manifests, man)
+		}
+	}
+	if len(manifests) == len(bag.manifests) {
+		return fmt.Errorf("bag has no manifest-%s.txt", alg)
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("can't remove the last payload manifest")
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return err
+	}
+	removed := []string{fmt.Sprintf("manifest-%s.txt", alg)}
+	var tagManifests []*Manifest
+	for _, man := range bag.tagManifests {
+		if man.algorithm == alg {
+			removed = append(removed, man.Filename())
+		} else {
+			tagManifests = append(tagManifests, man)
+		}
+	}
+	for _, man := range tagManifests {
+		for _, name := range removed {
+			delete(man.entries, EncodePath(name).Norm())
+		}
+	}
+	bag.manifests, bag.tagManifests = manifests, tagManifests
+	edit.removes = removed
+	return bag.commit(edit)
+}
@@ -0,0 +1,439 @@
+package bago
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/srerickson/bago/backend"
+	"github.com/srerickson/bago/test"
+)
+
+func TestPayloadEdits(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:           src,
+		InPlace:          true,
+		Algorithms:       []string{`sha256`, `md5`},
+		PreserveMetadata: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(test.TmpDataPath(map[string][]byte{`new.txt`: []byte(`new file`)}), `new.txt`)
+	defer os.RemoveAll(filepath.Dir(newFile))
+
+	checkBag := func(step string, oxum string, metaCount int) {
+		for _, b := range []*Bag{bag, nil} {
+			if b == nil { // also check the bag as stored
+				if b, err = OpenBag(src); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := b.IsValid(); err != nil {
+				t.Errorf("%s: %s", step, err)
+			}
+			if got := b.Info.Get(PayloadOxumTag); len(got) != 1 || got[0] != oxum {
+				t.Errorf("%s: expected Payload-Oxum %s, got %v", step, oxum, got)
+			}
+			metas, err := b.Metadata()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metas) != metaCount {
+				t.Errorf("%s: expected %d metadata entries, got %d", step, metaCount, len(metas))
+			}
+		}
+	}
+	checkBag(`create`, `28.2`, 4)
+
+	if err := bag.AddPayload(newFile, `dir2/new.txt`); err != nil {
+		t.Fatal(err)
+	}
+	checkBag(`add`, `36.3`, 5)
+	if err := bag.AddPayload(newFile, `file1.txt`); err == nil {
+		t.Error("expected an error adding an existing payload file")
+	}
+	if err := bag.AddPayload(newFile, `../outside.txt`); err == nil {
+		t.Error("expected an error adding a file outside of the payload")
+	}
+
+	if err := bag.RenamePayload(`dir2/new.txt`, `renamed.txt`); err != nil {
+		t.Fatal(err)
+	}
+	checkBag(`rename`, `36.3`, 5)
+	data, err := ioutil.ReadFile(filepath.Join(src, `data`, `renamed.txt`))
+	if err != nil || string(data) != `new file` {
+		t.Errorf("expected renamed file in payload: %s", err)
+	}
+
+	if err := bag.RemovePayload(`file1.txt`); err != nil {
+		t.Fatal(err)
+	}
+	checkBag(`remove`, `22.2`, 4)
+	if _, err := os.Stat(filepath.Join(src, `data`, `file1.txt`)); !os.IsNotExist(err) {
+		t.Error("expected removed file to be deleted")
+	}
+	if err := bag.RemovePayload(`file1.txt`); err == nil {
+		t.Error("expected an error removing a file not in the payload")
+	}
+}
+
+func TestRemovePayloadError(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:           src,
+		InPlace:          true,
+		Algorithms:       []string{`md5`},
+		PreserveMetadata: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(src, metadataTxt), []byte("not json\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = bag.RemovePayload(`file1.txt`); err == nil {
+		t.Fatal("expected an error with unreadable metadata")
+	}
+	if _, exists := bag.manifests[0].entries[EncodePath(`data/file1.txt`).Norm()]; !exists {
+		t.Error("expected the manifest entry to be kept")
+	}
+}
+
+// readOnly is a backend without the methods of backend.Mutable
+type readOnly struct {
+	backend.Backend
+}
+
+func TestReadOnlyPayloadEdits(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	if _, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}}); err != nil {
+		t.Fatal(err)
+	}
+	newFile := filepath.Join(src, `new.txt`)
+	if err := ioutil.WriteFile(newFile, []byte(`new`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bag := &Bag{Backend: readOnly{&backend.FS{Path: src}}}
+	if err := bag.Hydrate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, edit := range map[string]func() error{
+		`AddPayload`:    func() error { return bag.AddPayload(newFile, `new.txt`) },
+		`RemovePayload`: func() error { return bag.RemovePayload(`file1.txt`) },
+		`RenamePayload`: func() error { return bag.RenamePayload(`file1.txt`, `moved.txt`) },
+	} {
+		if err := edit(); err != errReadOnly {
+			t.Errorf("%s: expected %v, got %v", name, errReadOnly, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(src, `data`, stagedName(`new.txt`))); !os.IsNotExist(err) {
+		t.Error("expected nothing to be staged")
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInterruptedCommit(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitHook = func() error {
+		for _, name := range []string{commitJournal, `data/file1.txt`, stagedName(`manifest-md5.txt`)} {
+			if _, err := os.Stat(filepath.Join(src, name)); err != nil {
+				t.Errorf("expected %s before the commit is applied", name)
+			}
+		}
+		return errors.New(`interrupted`)
+	}
+	defer func() { commitHook = nil }()
+	if err = bag.RenamePayload(`file1.txt`, `moved.txt`); err == nil {
+		t.Fatal("expected the commit to be interrupted")
+	}
+	commitHook = nil
+	// the journal is replayed when the bag is opened
+	if bag, err = OpenBag(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(src, commitJournal)); !os.IsNotExist(err) {
+		t.Error("expected the journal to be removed")
+	}
+	if _, exists := bag.payload[EncodePath(`data/moved.txt`).Norm()]; !exists {
+		t.Error("expected the rename to be completed")
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestBagUpdate(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		src := test.TmpDataPath(map[string][]byte{
+			`file1.txt`:      []byte(`this is file 1`),
+			`dir1/file2.txt`: []byte(`this is file 2`),
+			`dir1/file3.txt`: []byte(`this is file 3`),
+			`dir1/file4.txt`: []byte(`this is file 4`),
+			`dir1/file5.txt`: []byte(`this is file 5`),
+		})
+		defer os.RemoveAll(src)
+		bag, err := CreateBag(&CreateBagOptions{
+			SrcDir:           src,
+			InPlace:          true,
+			Algorithms:       []string{`md5`, `sha256`},
+			PreserveMetadata: preserve,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary, err := bag.Update(&UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !summary.Empty() {
+			t.Errorf("expected no changes, got %v", summary)
+		}
+		later := time.Now().Add(time.Minute)
+		dataPath := filepath.Join(src, `data`)
+		writes := map[string]string{
+			`file1.txt`:      `this is file 1`, // touched, but unchanged
+			`dir1/file2.txt`: `this is file 2, changed`,
+			`new.txt`:        `this is new`,
+		}
+		for p, content := range writes {
+			if err := ioutil.WriteFile(filepath.Join(dataPath, p), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(filepath.Join(dataPath, p), later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// replaced, keeping an old modification time, as with cp -p
+		replaced := filepath.Join(dataPath, `dir1`, `file4.txt`)
+		earlier := time.Now().Add(-time.Hour)
+		if err := ioutil.WriteFile(replaced, []byte(`this is file 4, replaced`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(replaced, earlier, earlier); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dataPath, `dir1`, `file3.txt`)); err != nil {
+			t.Fatal(err)
+		}
+		// unchanged, but missing from one manifest
+		dropManifestLine(t, src, `manifest-sha256.txt`, ` data/dir1/file5.txt`)
+		if bag, err = OpenBag(src); err != nil {
+			t.Fatal(err)
+		}
+		if summary, err = bag.Update(nil); err != nil {
+			t.Fatal(err)
+		}
+		expect := UpdateSummary{
+			Added:    []string{`data/new.txt`},
+			Modified: []string{`data/dir1/file2.txt`, `data/dir1/file4.txt`},
+			Removed:  []string{`data/dir1/file3.txt`},
+			Repaired: []string{`data/dir1/file5.txt`},
+		}
+		if !reflect.DeepEqual(*summary, expect) {
+			t.Errorf("metadata=%v: expected %v, got %v", preserve, expect, *summary)
+		}
+		bag, err = OpenBag(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bag.IsValid(); err != nil {
+			t.Errorf("metadata=%v: %s", preserve, err)
+		}
+	}
+}
+
+func TestAddRemoveManifest(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:     src,
+		InPlace:    true,
+		Algorithms: []string{`md5`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.AddManifest(`SHA-256`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.AddManifest(`md5`, &ValidateOptions{}); err == nil {
+		t.Error("expected an error adding an existing manifest")
+	}
+	if err := bag.RemoveManifest(`md5`); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.RemoveManifest(`sha256`); err == nil {
+		t.Error("expected an error removing the last manifest")
+	}
+	if bag, err = OpenBag(src); err != nil {
+		t.Fatal(err)
+	}
+	if len(bag.manifests) != 1 || bag.manifests[0].algorithm != `sha256` {
+		t.Errorf("expected only a sha256 manifest")
+	}
+	if len(bag.tagManifests) != 1 || len(bag.tagManifests[0].entries) != 3 {
+		t.Errorf("expected a sha256 tag manifest with 3 entries")
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+
+	// the new manifest isn't added if the bag is invalid
+	err = ioutil.WriteFile(filepath.Join(src, `data`, `file1.txt`), []byte(`changed`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.AddManifest(`md5`, &ValidateOptions{}); err == nil {
+		t.Error("expected an error adding a manifest to an invalid bag")
+	}
+	if _, err := os.Stat(filepath.Join(src, `manifest-md5.txt`)); !os.IsNotExist(err) {
+		t.Error("expected manifest not to be written")
+	}
+}
+
+func TestSaveTags(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:     src,
+		InPlace:    true,
+		Algorithms: []string{`md5`, `sha256`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tag file that isn't modeled, edited by hand
+	extra := filepath.Join(src, `extra-tags.txt`)
+	if err := ioutil.WriteFile(extra, []byte("Note: one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.SaveTags(); err != nil {
+		t.Fatal(err)
+	}
+	// list the extra tag file in the tag manifests, then change it
+	if bag, err = OpenBag(src); err != nil {
+		t.Fatal(err)
+	}
+	for _, man := range bag.tagManifests {
+		man.entries[EncodePath(`extra-tags.txt`).Norm()] = ManifestEntry{path: `extra-tags.txt`}
+	}
+	if err := ioutil.WriteFile(extra, []byte("Note: two\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bag.Info.Set(`Contact-Name`, `Someone`)
+	if !bag.Info.Delete(`Bag-Software-Agent`) {
+		t.Error("expected Bag-Software-Agent tag to be deleted")
+	}
+	if err := bag.SaveTags(); err != nil {
+		t.Fatal(err)
+	}
+	if bag, err = OpenBag(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+	if got := bag.Info.Get(`Contact-Name`); len(got) != 1 || got[0] != `Someone` {
+		t.Errorf("expected saved Contact-Name, got %v", got)
+	}
+	if bag.Info.Has(`Bag-Software-Agent`) {
+		t.Error("expected Bag-Software-Agent to be removed")
+	}
+}
+
+func TestConvertEncoding(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`café.txt`: []byte(`coffee`)})
+	defer os.RemoveAll(src)
+	info := TagFile{}
+	info.Append(ContactNameTag, `José`)
+	bag, err := CreateBag(&CreateBagOptions{
+		SrcDir:     src,
+		InPlace:    true,
+		Algorithms: []string{`md5`},
+		Info:       info,
+		Encoding:   `ISO-8859-1`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.ConvertEncoding(`UTF-8`); err != nil {
+		t.Fatal(err)
+	}
+	checkFile := func(name string, expected string) {
+		data, err := ioutil.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("expected %s to contain %q, got %q", name, expected, data)
+		}
+	}
+	checkFile(bagitTxt, `Tag-File-Character-Encoding: UTF-8`)
+	checkFile(bagInfo, `José`)
+	checkFile(`manifest-md5.txt`, `data/café.txt`)
+	if bag, err = OpenBag(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+
+	// nothing is written if a character can't be represented
+	bag.Info.Set(ContactNameTag, `☃`)
+	if err := bag.SaveTags(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.ConvertEncoding(`ISO-8859-1`); err == nil {
+		t.Error("expected an error for a character not in ISO-8859-1")
+	}
+	checkFile(bagitTxt, `Tag-File-Character-Encoding: UTF-8`)
+	checkFile(bagInfo, `☃`)
+	if bag.encoding != `UTF-8` {
+		t.Errorf("expected encoding UTF-8 after failed conversion, got %s", bag.encoding)
+	}
+	if err := bag.ConvertEncoding(`no-such-encoding`); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+}
+
+func TestFetchWrite(t *testing.T) {
+	input := "http://example.com/file1.txt 14 data/file1.txt\nhttp://example.com/file2.txt - data/dir 1/file2.txt\n"
+	var f fetch
+	if err := f.parse(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != input {
+		t.Errorf("expected %q, got %q", input, buf.String())
+	}
+}
@@ -0,0 +1,204 @@
+package bago
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/srerickson/bago/checksum"
+)
+
+// UpdateOptions is used to pass options to Update(). Without Rehash, a
+// file is assumed to be unchanged if its size and modification time match
+// the bag's metadata (see CreateBagOptions.PreserveMetadata), so a change
+// that keeps both, such as a same-sized file restored with its old
+// modification time, isn't detected. Every file of a bag without metadata
+// is rehashed.
+type UpdateOptions struct {
+	Workers int
+	Rehash  bool // rehash every file instead of using size and modification time hints
+
+	RateLimit     int64 // max bytes read per second for checksums, if > 0
+	DeviceWorkers int   // max concurrent reads per storage device, if > 0
+}
+
+// UpdateSummary lists the payload files changed by Update. Paths are
+// relative to the bag.
+type UpdateSummary struct {
+	Added    []string
+	Modified []string
+	Removed  []string
+	Repaired []string // unchanged files added to payload manifests that didn't list them
+}
+
+// Empty returns true if no payload files or manifest entries were changed
+func (s *UpdateSummary) Empty() bool {
+	return len(s.Added) == 0 && len(s.Modified) == 0 && len(s.Removed) == 0 &&
+		len(s.Repaired) == 0
+}
+
+// Update brings the bag's manifests up to date with its payload directory.
+// New files and files that appear to have changed are hashed, and entries
+// for deleted files are dropped. A file is assumed to be unchanged if its
+// size and modification time match the bag's metadata. Unchanged files
+// missing from some payload manifests are added to them. The payload
+// manifests, Payload-Oxum, metadata and tag manifests are rewritten if
+// anything changed.
+func (bag *Bag) Update(opts *UpdateOptions) (*UpdateSummary, error) {
+	if err := bag.loadPayload(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	infos := map[NormPath]os.FileInfo{}
+	payload := Payload{}
+	err := bag.Walk(dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		p = filepath.ToSlash(p)
+		norm := EncodePath(p).Norm()
+		if _, exists := payload[norm]; exists {
+			return fmt.Errorf("path encoding collision: %s", p)
+		}
+		infos[norm] = info
+		if info.Mode()&os.ModeSymlink != 0 { // preserved link
+			if info, err = bag.Stat(p); err != nil {
+				return err
+			}
+		}
+		payload[norm] = PayloadEntry{path: p, size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	edit, err := bag.newPayloadEdit()
+	if err != nil {
+		return nil, err
+	}
+	metas := map[string]int{}
+	for i, meta := range edit.metas {
+		metas[meta.Path] = i
+	}
+	unchanged := func(entry PayloadEntry, info os.FileInfo) bool {
+		if opts.Rehash {
+			return false
+		}
+		if i, exists := metas[entry.path]; exists {
+			meta := edit.metas[i]
+			return meta.Size == info.Size() && meta.ModTime.Equal(info.ModTime())
+		}
+		return false
+	}
+
+	summary := &UpdateSummary{}
+	var jobs []checksum.Job
+	for norm, entry := range payload {
+		inAll := true
+		for _, man := range bag.manifests {
+			if _, exists := man.entries[norm]; !exists {
+				inAll = false
+			}
+		}
+		if inAll && unchanged(entry, infos[norm]) {
+			continue
+		}
+		job := checksum.Job{Path: entry.path, Expected: map[string][]byte{}}
+		for _, man := range bag.manifests {
+			job.Algs = append(job.Algs, man.algorithm)
+			if manEntry, exists := man.entries[norm]; exists {
+				job.Expected[man.algorithm] = manEntry.sum
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	sumOpts := []checksum.Option{
+		checksum.WithRateLimit(opts.RateLimit),
+		checksum.WithDeviceLimit(opts.DeviceWorkers),
+	}
+	sumer := checksum.New(opts.Workers, bag.Backend, func(push checksum.JobPusher) error {
+		for _, job := range jobs {
+			push(job)
+		}
+		return nil
+	}, sumOpts...)
+	changedMetas := false
+	for job := range sumer.Results() {
+		if err != nil {
+			continue // drain remaining results
+		}
+		if err = job.Err; err != nil {
+			sumer.Cancel()
+			continue
+		}
+		norm := EncodePath(job.Path).Norm()
+		modified, repaired := false, false
+		for _, man := range bag.manifests {
+			expected, listed := job.Expected[man.algorithm]
+			if listed && bytes.Equal(job.Sums[man.algorithm], expected) {
+				continue
+			}
+			if listed {
+				modified = true
+			} else {
+				repaired = true
+			}
+			man.entries[norm] = ManifestEntry{path: job.Path, sum: job.Sums[man.algorithm]}
+		}
+		if len(job.Expected) == 0 {
+			summary.Added = append(summary.Added, job.Path)
+		} else if modified {
+			summary.Modified = append(summary.Modified, job.Path)
+		} else if repaired {
+			summary.Repaired = append(summary.Repaired, job.Path)
+		}
+		if edit.hasMetas {
+			meta := newFileMetadata(job.Path[len(dataDir)+1:], infos[norm])
+			if i, exists := metas[job.Path]; exists {
+				meta.Link = edit.metas[i].Link
+				edit.metas[i] = meta
+			} else {
+				edit.metas = append(edit.metas, meta)
+			}
+			changedMetas = true
+		}
+	}
+	if err == nil {
+		err = sumer.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	removed := map[NormPath]string{}
+	for _, man := range bag.manifests {
+		for norm, entry := range man.entries {
+			if _, exists := payload[norm]; !exists {
+				removed[norm] = entry.path
+				delete(man.entries, norm)
+			}
+		}
+	}
+	for _, p := range removed {
+		summary.Removed = append(summary.Removed, p)
+		if _, exists := metas[p]; exists {
+			edit.metas = edit.metas.without(p)
+			changedMetas = true
+		}
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Modified)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.Repaired)
+	bag.payload = payload
+	if summary.Empty() && !changedMetas {
+		return summary, nil
+	}
+	return summary, bag.commit(edit)
+}
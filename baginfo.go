@@ -0,0 +1,151 @@
+package bago
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reserved bag-info.txt labels
+const (
+	SourceOrganizationTag        = `Source-Organization`
+	OrganizationAddressTag       = `Organization-Address`
+	ContactNameTag               = `Contact-Name`
+	ContactPhoneTag              = `Contact-Phone`
+	ContactEmailTag              = `Contact-Email`
+	ExternalDescriptionTag       = `External-Description`
+	BaggingDateTag               = `Bagging-Date`
+	ExternalIdentifierTag        = `External-Identifier`
+	PayloadOxumTag               = `Payload-Oxum`
+	BagSizeTag                   = `Bag-Size`
+	BagGroupIdentifierTag        = `Bag-Group-Identifier`
+	BagCountTag                  = `Bag-Count`
+	InternalSenderIdentifierTag  = `Internal-Sender-Identifier`
+	InternalSenderDescriptionTag = `Internal-Sender-Description`
+)
+
+const baggingDateLayout = `2006-01-02`
+
+// nonRepeatableTags are reserved tags that should appear at most once
+var nonRepeatableTags = []string{
+	BaggingDateTag, PayloadOxumTag, BagSizeTag, BagGroupIdentifierTag, BagCountTag,
+}
+
+// ErrTagNotSet is returned by typed tag accessors if the tag isn't present
+var ErrTagNotSet = errors.New("tag not set")
+
+var (
+	payloadOxumRE = regexp.MustCompile(`^(\d+)\.(\d+)$`)
+	bagCountRE    = regexp.MustCompile(`^(\d+) of (\d+|\?)$`)
+)
+
+// BaggingDate returns the value of Bagging-Date, an ISO 8601 date
+func (tf *TagFile) BaggingDate() (time.Time, error) {
+	val, exists := tf.Value(BaggingDateTag)
+	if !exists {
+		return time.Time{}, ErrTagNotSet
+	}
+	date, err := time.Parse(baggingDateLayout, strings.TrimSpace(val))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is not a YYYY-MM-DD date: %s", BaggingDateTag, val)
+	}
+	return date, nil
+}
+
+// PayloadOxum returns the octet count and stream (file) count from
+// Payload-Oxum
+func (tf *TagFile) PayloadOxum() (octets int64, streams int64, err error) {
+	val, exists := tf.Value(PayloadOxumTag)
+	if !exists {
+		return 0, 0, ErrTagNotSet
+	}
+	match := payloadOxumRE.FindStringSubmatch(strings.TrimSpace(val))
+	if match == nil {
+		return 0, 0, fmt.Errorf("%s is not in the form octets.streams: %s", PayloadOxumTag, val)
+	}
+	octets, err = strconv.ParseInt(match[1], 10, 64)
+	if err == nil {
+		streams, err = strconv.ParseInt(match[2], 10, 64)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %s", PayloadOxumTag, err.Error())
+	}
+	return octets, streams, nil
+}
+
+// BagCount returns the bag's number and the total number of bags in its
+// group from Bag-Count. total is 0 if it is unknown ("?").
+func (tf *TagFile) BagCount() (n int, total int, err error) {
+	val, exists := tf.Value(BagCountTag)
+	if !exists {
+		return 0, 0, ErrTagNotSet
+	}
+	match := bagCountRE.FindStringSubmatch(strings.TrimSpace(val))
+	if match == nil {
+		return 0, 0, fmt.Errorf("%s is not in the form 'N of T': %s", BagCountTag, val)
+	}
+	n, err = strconv.Atoi(match[1])
+	if err == nil && match[2] != `?` {
+		total, err = strconv.Atoi(match[2])
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %s", BagCountTag, err.Error())
+	}
+	if n < 1 || total > 0 && n > total {
+		return 0, 0, fmt.Errorf("%s is out of range: %s", BagCountTag, val)
+	}
+	return n, total, nil
+}
+
+// ExternalIdentifiers returns the values of External-Identifier
+func (tf *TagFile) ExternalIdentifiers() []string {
+	return tf.Get(ExternalIdentifierTag)
+}
+
+// BagGroupIdentifier returns the value of Bag-Group-Identifier
+func (tf *TagFile) BagGroupIdentifier() (string, bool) {
+	return tf.Value(BagGroupIdentifierTag)
+}
+
+// BagSize returns the value of Bag-Size, a human readable size
+func (tf *TagFile) BagSize() (string, bool) {
+	return tf.Value(BagSizeTag)
+}
+
+// bagInfoFindings checks the reserved elements of bag-info.txt. Payload-Oxum
+// is checked against the payload unless the bag has a fetch file.
+func (bag *Bag) bagInfoFindings() Findings {
+	var findings Findings
+	info := &bag.Info
+	for _, label := range nonRepeatableTags {
+		if n := len(info.Get(label)); n > 1 {
+			findings.add(Warning, `repeated-tag`, bagInfo, "%s appears %d times", label, n)
+		}
+	}
+	if _, err := info.BaggingDate(); err != nil && err != ErrTagNotSet {
+		findings.add(Warning, `invalid-bagging-date`, bagInfo, "%s", err.Error())
+	}
+	if _, _, err := info.BagCount(); err != nil && err != ErrTagNotSet {
+		findings.add(Warning, `invalid-bag-count`, bagInfo, "%s", err.Error())
+	}
+	octets, streams, err := info.PayloadOxum()
+	switch {
+	case err == ErrTagNotSet:
+	case err != nil:
+		findings.add(Error, `invalid-payload-oxum`, bagInfo, "%s", err.Error())
+	case len(bag.fetch) == 0 && (bag.payload != nil || bag.stream != nil && bag.stream.walked):
+		size, count := bag.payload.totals()
+		if bag.stream != nil {
+			size, count = bag.stream.size, bag.stream.count
+		}
+		if size != octets || count != streams {
+			findings.add(Error, `payload-oxum-mismatch`, bagInfo,
+				"%s is %d.%d, but the payload has %d bytes in %d files",
+				PayloadOxumTag, octets, streams, size, count)
+		}
+	}
+	return findings
+}
@@ -0,0 +1,95 @@
+package bago
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+func TestBagInfoAccessors(t *testing.T) {
+	tf := &TagFile{}
+	err := tf.parse(strings.NewReader("Bagging-Date: 2020-03-05\nPayload-Oxum: 1024.3\nBag-Count: 2 of ?\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date, err := tf.BaggingDate(); err != nil || date.Format(`2006-01-02`) != `2020-03-05` {
+		t.Errorf("unexpected Bagging-Date: %v, %v", date, err)
+	}
+	if octets, streams, err := tf.PayloadOxum(); err != nil || octets != 1024 || streams != 3 {
+		t.Errorf("unexpected Payload-Oxum: %d.%d, %v", octets, streams, err)
+	}
+	if n, total, err := tf.BagCount(); err != nil || n != 2 || total != 0 {
+		t.Errorf("unexpected Bag-Count: %d of %d, %v", n, total, err)
+	}
+	if _, exists := tf.BagSize(); exists {
+		t.Error("expected Bag-Size to be unset")
+	}
+
+	bad := map[string]string{
+		BaggingDateTag: `March 5, 2020`,
+		PayloadOxumTag: `1024`,
+		BagCountTag:    `3 of 2`,
+	}
+	for label, val := range bad {
+		tf.Set(label, val)
+	}
+	if _, err := tf.BaggingDate(); err == nil {
+		t.Error("expected an error for an invalid Bagging-Date")
+	}
+	if _, _, err := tf.PayloadOxum(); err == nil {
+		t.Error("expected an error for an invalid Payload-Oxum")
+	}
+	if _, _, err := tf.BagCount(); err == nil {
+		t.Error("expected an error for an out of range Bag-Count")
+	}
+	tf.Delete(BagCountTag)
+	if _, _, err := tf.BagCount(); err != ErrTagNotSet {
+		t.Errorf("expected ErrTagNotSet, got %v", err)
+	}
+}
+
+func TestBagFindings(t *testing.T) {
+	for version, group := range testBags() {
+		for name, path := range group.valid {
+			bag, err := OpenBag(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			findings := bag.Findings()
+			if errs := findings.Errors(); len(errs) > 0 {
+				t.Errorf("unexpected error findings (%s, %s): %v", version, name, errs)
+			}
+			if name != `duplicate-metadata-entries` || version != `v0.97` {
+				continue
+			}
+			warnings := findings.Warnings()
+			if len(warnings) != 1 || warnings[0].Code != `repeated-tag` ||
+				!strings.HasPrefix(warnings[0].Message, BaggingDateTag) {
+				t.Errorf("expected a repeated-tag warning for %s, got %v", BaggingDateTag, warnings)
+			}
+		}
+	}
+
+	src := test.TmpDataPath(map[string][]byte{`file.txt`: []byte(`content`)})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oxum, _ := bag.Info.Value(PayloadOxumTag); oxum != `7.1` {
+		t.Errorf("expected Payload-Oxum 7.1, got %s", oxum)
+	}
+	if _, err := bag.Info.BaggingDate(); err != nil {
+		t.Error(err)
+	}
+	bag.Info.Set(PayloadOxumTag, `8.1`)
+	errs := bag.Findings().Errors()
+	if len(errs) != 1 || errs[0].Code != `payload-oxum-mismatch` {
+		t.Errorf("expected a payload-oxum-mismatch error, got %v", errs)
+	}
+	if err := bag.Validate(nil); err == nil {
+		t.Error("expected Validate to fail with a mismatched Payload-Oxum")
+	}
+}
@@ -0,0 +1,240 @@
+package checksum
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CachePolicy determines how a Checksumer uses its Cache
+type CachePolicy int
+
+const (
+	// TrustCache uses cached sums for files whose size, modification time and
+	// inode are unchanged since the sums were cached.
+	TrustCache CachePolicy = iota
+	// AlwaysRehash reads every file. The cache is updated with the results.
+	AlwaysRehash
+)
+
+// CacheKey identifies a file's state when its checksums were computed.
+// Where the platform supports it, the file is identified by its device and
+// inode numbers, so that a cache can be shared by several bags and sums
+// cached for a file are reused after it is moved (for example, into a new
+// bag). Otherwise it is identified by Path.
+type CacheKey struct {
+	Path    string // absolute path of the file, where the backend has one
+	Size    int64
+	ModTime time.Time
+	Device  uint64 // zero if not supported on the platform
+	Inode   uint64 // zero if not supported on the platform
+}
+
+// NewCacheKey returns a CacheKey for the file at path with info fi
+func NewCacheKey(path string, fi os.FileInfo) CacheKey {
+	dev, ino, _ := fileID(fi)
+	return CacheKey{
+		Path:    path,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Device:  dev,
+		Inode:   ino,
+	}
+}
+
+// id identifies the file of the key in a cache
+func (k CacheKey) id() string {
+	if k.Inode != 0 {
+		return fmt.Sprintf("%d:%d", k.Device, k.Inode)
+	}
+	return k.Path
+}
+
+// Cache stores checksums so that unchanged files don't need to be rehashed.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the cached sum for alg if the cached entry for the key's
+	// file was stored with the same key.
+	Get(key CacheKey, alg string) ([]byte, bool)
+	// Put stores the sum for alg. Sums for other algorithms stored with a
+	// different key are discarded.
+	Put(key CacheKey, alg string, sum []byte) error
+	// Invalidate removes all sums for the key's file.
+	Invalidate(key CacheKey) error
+}
+
+// FileCache is a Cache stored in a sidecar file. Changes are appended to the
+// file as they are made, so sums computed before an interruption are not
+// lost. The file is compacted when the cache is closed.
+type FileCache struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a line in the cache file. An entry without sums removes
+// the path from the cache.
+type cacheEntry struct {
+	Path   string            `json:"path"`
+	Size   int64             `json:"size,omitempty"`
+	MTime  int64             `json:"mtime,omitempty"`
+	Device uint64            `json:"device,omitempty"`
+	Inode  uint64            `json:"inode,omitempty"`
+	Sums   map[string]string `json:"sums,omitempty"`
+}
+
+func (e *cacheEntry) id() string {
+	return CacheKey{Path: e.Path, Device: e.Device, Inode: e.Inode}.id()
+}
+
+func (e *cacheEntry) matches(key CacheKey) bool {
+	return e.Size == key.Size &&
+		e.MTime == key.ModTime.UnixNano() &&
+		e.Device == key.Device &&
+		e.Inode == key.Inode
+}
+
+// OpenFileCache opens the cache file at path, creating it if necessary.
+func OpenFileCache(path string) (*FileCache, error) {
+	c := &FileCache{path: path, entries: map[string]*cacheEntry{}}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var e cacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // ignore lines from interrupted writes
+		}
+		if len(e.Sums) == 0 {
+			delete(c.entries, e.id())
+			continue
+		}
+		c.entries[e.id()] = &e
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// the file may end with a partial line
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteString("\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.file = f
+	return c, nil
+}
+
+func (c *FileCache) Get(key CacheKey, alg string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key.id()]
+	if !ok || !e.matches(key) {
+		return nil, false
+	}
+	sum, err := hex.DecodeString(e.Sums[alg])
+	if err != nil || len(sum) == 0 {
+		return nil, false
+	}
+	return sum, true
+}
+
+func (c *FileCache) Put(key CacheKey, alg string, sum []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key.id()]
+	if !ok || !e.matches(key) {
+		e = &cacheEntry{
+			Path:   key.Path,
+			Size:   key.Size,
+			MTime:  key.ModTime.UnixNano(),
+			Device: key.Device,
+			Inode:  key.Inode,
+			Sums:   map[string]string{},
+		}
+		c.entries[key.id()] = e
+	}
+	e.Sums[alg] = hex.EncodeToString(sum)
+	return c.append(e)
+}
+
+func (c *FileCache) Invalidate(key CacheKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key.id()]; !ok {
+		return nil
+	}
+	delete(c.entries, key.id())
+	return c.append(&cacheEntry{Path: key.Path, Device: key.Device, Inode: key.Inode})
+}
+
+// append writes e to the end of the cache file. The caller must hold c.mu.
+func (c *FileCache) append(e *cacheEntry) error {
+	if c.file == nil {
+		return os.ErrClosed
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close compacts and closes the cache file.
+func (c *FileCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return os.ErrClosed
+	}
+	c.file.Close()
+	c.file = nil
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path))
+	if err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	keys := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // so the file's order is stable
+	for _, key := range keys {
+		if err = enc.Encode(c.entries[key]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
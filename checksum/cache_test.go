@@ -0,0 +1,194 @@
+package checksum
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/backend"
+)
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `bagoCache`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, `cache`)
+	fs := testBag()
+	fi, err := fs.Stat(`bagit.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewCacheKey(`bagit.txt`, fi)
+	bogus := []byte{1, 2, 3}
+
+	cache, err := OpenFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put(key, MD5, bogus); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = OpenFileCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	if sum, ok := cache.Get(key, MD5); !ok || !bytes.Equal(sum, bogus) {
+		t.Fatal("expected cached sum to persist after Close")
+	}
+	changed := key
+	changed.Size++
+	if _, ok := cache.Get(changed, MD5); ok {
+		t.Error("expected cache miss for a changed file")
+	}
+
+	run := func(policy CachePolicy, expected []byte) Job {
+		var result Job
+		c := New(1, fs, func(push JobPusher) error {
+			j := Job{Path: `bagit.txt`, Algs: []string{MD5}}
+			if expected != nil {
+				j.Expected = map[string][]byte{MD5: expected}
+			}
+			push(j)
+			return nil
+		}, WithCache(cache, policy))
+		for r := range c.Results() {
+			result = r
+		}
+		return result
+	}
+	if r := run(TrustCache, nil); !bytes.Equal(r.Sums[MD5], bogus) {
+		t.Error("expected TrustCache to use the cached sum")
+	}
+	real := run(AlwaysRehash, nil).Sums[MD5]
+	if bytes.Equal(real, bogus) {
+		t.Error("expected AlwaysRehash to ignore the cached sum")
+	}
+	if sum, _ := cache.Get(key, MD5); !bytes.Equal(sum, real) {
+		t.Error("expected AlwaysRehash to update the cache")
+	}
+	cache.Put(key, MD5, bogus)
+	if r := run(TrustCache, real); !r.SumIsExpected() {
+		t.Error("expected mismatched cached sum to be rehashed")
+	}
+	cache.Put(key, MD5, real)
+	if r := run(TrustCache, bogus); r.SumIsExpected() {
+		t.Error("expected checksum mismatch")
+	}
+	if _, ok := cache.Get(key, MD5); ok {
+		t.Error("expected mismatch to invalidate the cache entry")
+	}
+}
+
+func TestFileCacheShared(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `bagoCache`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// two bags with the same relative path
+	var bags []*backend.FS
+	for _, name := range []string{`bag1`, `bag2`} {
+		p := filepath.Join(dir, name, `data`)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(p, `a.txt`), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		bags = append(bags, &backend.FS{Path: filepath.Join(dir, name)})
+	}
+	cache, err := OpenFileCache(filepath.Join(dir, `cache`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+	run := func(fs backend.Backend) Job {
+		var result Job
+		c := New(1, fs, func(push JobPusher) error {
+			push(Job{Path: `data/a.txt`, Algs: []string{MD5}})
+			return nil
+		}, WithCache(cache, TrustCache))
+		for r := range c.Results() {
+			result = r
+		}
+		return result
+	}
+	sums := map[string][]byte{}
+	for _, fs := range bags {
+		sums[fs.Path] = run(fs).Sums[MD5]
+	}
+	for _, fs := range bags {
+		if r := run(fs); !r.Cached || !bytes.Equal(r.Sums[MD5], sums[fs.Path]) {
+			t.Errorf("expected the cached sum for %s", fs.Path)
+		}
+	}
+
+	// a moved file keeps its cached sums where inodes are supported
+	fi, err := os.Stat(filepath.Join(bags[0].Path, `data`, `a.txt`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := fileID(fi); !ok {
+		return
+	}
+	moved := &backend.FS{Path: filepath.Join(dir, `moved`)}
+	if err := os.Rename(bags[0].Path, moved.Path); err != nil {
+		t.Fatal(err)
+	}
+	if r := run(moved); !r.Cached || !bytes.Equal(r.Sums[MD5], sums[bags[0].Path]) {
+		t.Error("expected the cached sum for a moved file")
+	}
+}
+
+func TestFileCacheOrder(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `bagoCache`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, `cache`)
+	cache, err := OpenFileCache(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		key := CacheKey{Path: fmt.Sprintf("/file%02d", i*7%20), Size: 1}
+		if err := cache.Put(key, MD5, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(first)), "\n"); !sort.StringsAreSorted(lines) {
+		t.Errorf("expected cache entries in key order, got %q", lines)
+	}
+	// compacting again gives the same file
+	if cache, err = OpenFileCache(cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("expected the cache file not to change")
+	}
+}
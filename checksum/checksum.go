@@ -10,54 +10,157 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/srerickson/bago/backend"
 )
 
 // SHA512 = `sha512`
 const (
-	SHA512 = `sha512`
-	SHA256 = `sha256`
-	SHA224 = `sha224`
-	SHA1   = `sha1`
-	MD5    = `md5`
+	SHA512     = `sha512`
+	SHA384     = `sha384`
+	SHA256     = `sha256`
+	SHA224     = `sha224`
+	SHA512_256 = `sha512-256`
+	SHA512_224 = `sha512-224`
+	SHA3_512   = `sha3-512`
+	SHA3_384   = `sha3-384`
+	SHA3_256   = `sha3-256`
+	SHA3_224   = `sha3-224`
+	SHA1       = `sha1`
+	MD5        = `md5`
 )
 
-var availableAlgs = [...]string{SHA512, SHA256, SHA224, SHA1, MD5}
+// registry of available algorithms, keyed by algKey(name)
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]registeredAlg{}
+)
+
+type registeredAlg struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func init() {
+	Register(SHA512, sha512.New)
+	Register(SHA384, sha512.New384)
+	Register(SHA256, sha256.New)
+	Register(SHA224, sha256.New224)
+	Register(SHA512_256, sha512.New512_256)
+	Register(SHA512_224, sha512.New512_224)
+	Register(SHA1, sha1.New)
+	Register(MD5, md5.New)
+}
 
 type Checksumer struct {
 	jobs    chan Job
 	results chan Job
 	cancel  chan struct{}
 	pushErr chan error
+	err     error // returned by the job producer
 	fs      backend.Backend
+
+	cache       Cache
+	cachePolicy CachePolicy
+	limiter     *Limiter
+	devices     *deviceLimit
+}
+
+// Option configures optional Checksumer behavior
+type Option func(*Checksumer)
+
+// WithRateLimit limits the combined read rate of all workers to bytesPerSec
+// bytes per second. Values less than 1 mean no limit.
+func WithRateLimit(bytesPerSec int64) Option {
+	if bytesPerSec < 1 {
+		return func(*Checksumer) {}
+	}
+	return WithLimiter(NewLimiter(bytesPerSec))
+}
+
+// WithLimiter limits reads using a Limiter that may be shared with other
+// Checksumers.
+func WithLimiter(l *Limiter) Option {
+	return func(ch *Checksumer) {
+		ch.limiter = l
+	}
+}
+
+// WithDeviceLimit limits the number of files read concurrently from each
+// storage device. Where devices can't be identified, the limit applies to the
+// backend as a whole. Values less than 1 mean no limit.
+func WithDeviceLimit(n int) Option {
+	return func(ch *Checksumer) {
+		if n < 1 {
+			ch.devices = nil
+			return
+		}
+		ch.devices = &deviceLimit{max: n, sems: map[uint64]chan struct{}{}}
+	}
+}
+
+// WithCache sets a Cache for the Checksumer. Sums are read from the cache
+// according to policy. Computed sums are added to the cache, and files whose
+// sums don't match their expected values are removed from it.
+func WithCache(cache Cache, policy CachePolicy) Option {
+	return func(ch *Checksumer) {
+		ch.cache = cache
+		ch.cachePolicy = policy
+	}
 }
 
+// Job is a checksum task for a single file. All algorithms in Algs are
+// computed from one read of the file.
 type Job struct {
 	Path     string
-	Alg      string
-	Sum      []byte
-	Expected []byte
-	Err      error
+	Algs     []string
+	Sums     map[string][]byte // computed checksums, keyed by algorithm
+	Expected map[string][]byte // expected checksums, keyed by algorithm
+	Err      error             // a *JobError, if set by the Checksumer
+
+	Size     int64         // bytes read
+	Duration time.Duration // time spent reading and hashing
+	Cached   bool          // sums were read from the cache
 }
 
 type JobPusher func(Job)
 
+// SumIsExpected returns true if the job has sums and every expected sum
+// matches the computed sum for the same algorithm.
 func (j *Job) SumIsExpected() bool {
-	return j.Sum != nil && (bytes.Compare(j.Expected, j.Sum) == 0)
+	if len(j.Sums) == 0 {
+		return false
+	}
+	return len(j.Mismatches()) == 0
+}
+
+// Mismatches returns the algorithms for which the computed sum does not
+// match the expected sum.
+func (j *Job) Mismatches() []string {
+	var algs []string
+	for alg, exp := range j.Expected {
+		if !bytes.Equal(exp, j.Sums[alg]) {
+			algs = append(algs, alg)
+		}
+	}
+	sort.Strings(algs)
+	return algs
 }
 
-func (j *Job) SumString() string {
-	return hex.EncodeToString(j.Sum)
+func (j *Job) SumString(alg string) string {
+	return hex.EncodeToString(j.Sums[alg])
 }
 
-func (j *Job) ExpectedString() string {
-	return hex.EncodeToString(j.Expected)
+func (j *Job) ExpectedString(alg string) string {
+	return hex.EncodeToString(j.Expected[alg])
 }
 
-func New(wkc int, fs backend.Backend, p func(JobPusher) error) *Checksumer {
+func New(wkc int, fs backend.Backend, p func(JobPusher) error, opts ...Option) *Checksumer {
 	c := &Checksumer{
 		fs:      fs,
 		jobs:    make(chan Job),
@@ -65,14 +168,18 @@ func New(wkc int, fs backend.Backend, p func(JobPusher) error) *Checksumer {
 		cancel:  make(chan struct{}),
 		pushErr: make(chan error, 1),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	var wg sync.WaitGroup
 	go func() {
-		c.pushErr <- p(func(j Job) {
+		c.err = p(func(j Job) {
 			if c.Canceled() {
 				return
 			}
 			c.jobs <- j
 		})
+		c.pushErr <- c.err
 		close(c.jobs)
 		close(c.pushErr)
 	}()
@@ -93,23 +200,120 @@ func New(wkc int, fs backend.Backend, p func(JobPusher) error) *Checksumer {
 	return c
 }
 
+// Check computes checksums for all of the job's algorithms, reading the
+// file once. If the job fails, j.Err is set to a *JobError.
 func (ch *Checksumer) Check(j *Job) error {
+	start := time.Now()
+	if err := ch.check(j); err != nil {
+		j.Err = newJobError(j.Path, err)
+	}
+	j.Duration = time.Since(start)
+	return j.Err
+}
+
+func (ch *Checksumer) check(j *Job) error {
 	if j.Err != nil {
 		return j.Err
 	}
-	var h hash.Hash
-	if h, j.Err = NewHash(j.Alg); j.Err != nil {
-		return j.Err
+	if len(j.Algs) == 0 {
+		return fmt.Errorf(`No checksum algorithm given for %s`, j.Path)
 	}
-	var file io.ReadCloser
-	if file, j.Err = ch.fs.Open(j.Path); j.Err != nil {
-		return j.Err
+	if ch.cache == nil && ch.devices == nil {
+		return ch.hash(j)
+	}
+	fi, err := ch.fs.Stat(j.Path)
+	if err != nil {
+		return err
+	}
+	key := NewCacheKey(ch.cachePath(j.Path), fi)
+	if ch.cache != nil && ch.cachePolicy == TrustCache && ch.fromCache(j, key) {
+		return nil
+	}
+	if ch.devices != nil {
+		dev, _, _ := fileID(fi)
+		release := ch.devices.acquire(dev)
+		err = ch.hash(j)
+		release()
+	} else {
+		err = ch.hash(j)
+	}
+	if err != nil || ch.cache == nil {
+		return err
+	}
+	if len(j.Mismatches()) > 0 {
+		ch.cache.Invalidate(key)
+		return nil
+	}
+	for alg, sum := range j.Sums {
+		ch.cache.Put(key, alg, sum)
+	}
+	return nil
+}
+
+// cachePath returns the absolute path of the file at p, if the backend is
+// a file system
+func (ch *Checksumer) cachePath(p string) string {
+	fs, ok := ch.fs.(*backend.FS)
+	if !ok {
+		return p
+	}
+	abs, err := filepath.Abs(filepath.Join(fs.Path, p))
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+// fromCache sets the job's sums from the cache. It returns false if any sum
+// is missing from the cache or if the cached sums don't match the expected
+// sums, in which case the file should be rehashed.
+func (ch *Checksumer) fromCache(j *Job, key CacheKey) bool {
+	sums := make(map[string][]byte, len(j.Algs))
+	for _, alg := range j.Algs {
+		sum, ok := ch.cache.Get(key, alg)
+		if !ok {
+			return false
+		}
+		sums[alg] = sum
+	}
+	j.Sums = sums
+	if len(j.Mismatches()) > 0 {
+		ch.cache.Invalidate(key)
+		j.Sums = nil
+		return false
+	}
+	j.Cached = true
+	return true
+}
+
+// hash reads the file and sets the job's sums
+func (ch *Checksumer) hash(j *Job) error {
+	hashes := make([]hash.Hash, len(j.Algs))
+	writers := make([]io.Writer, len(j.Algs))
+	for i, alg := range j.Algs {
+		var err error
+		if hashes[i], err = NewHash(alg); err != nil {
+			return err
+		}
+		writers[i] = hashes[i]
+	}
+	file, err := ch.fs.Open(j.Path)
+	if err != nil {
+		return err
 	}
 	defer file.Close()
-	if _, j.Err = io.Copy(h, file); j.Err != nil {
-		return j.Err
+	var reader io.Reader = file
+	if ch.limiter != nil {
+		reader = ch.limiter.Reader(file)
+	}
+	j.Size, err = io.Copy(io.MultiWriter(writers...), reader)
+	if err != nil {
+		return err
+	}
+	j.Sums = make(map[string][]byte, len(j.Algs))
+	for i, alg := range j.Algs {
+		j.Sums[alg] = hashes[i].Sum(nil)
 	}
-	j.Sum = h.Sum(nil)
 	return nil
 }
 
@@ -121,6 +325,12 @@ func (ch *Checksumer) PushError() <-chan error {
 	return ch.pushErr
 }
 
+// Err returns the error returned by the job producer. It should be called
+// after the Results channel is closed.
+func (ch *Checksumer) Err() error {
+	return ch.err
+}
+
 func (ch *Checksumer) Cancel() {
 	select {
 	case <-ch.cancel:
@@ -139,33 +349,63 @@ func (ch *Checksumer) Canceled() bool {
 	}
 }
 
+// Register makes a checksum algorithm available by name. The name is used
+// in manifest filenames, so it is lowercased and should only use letters,
+// digits and hyphens. Registering an existing name replaces it.
+func Register(name string, newHash func() hash.Hash) {
+	key := algKey(name)
+	if key == `` || newHash == nil {
+		panic(`checksum: Register called with empty name or nil hash`)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[key] = registeredAlg{name: strings.ToLower(name), newHash: newHash}
+}
+
+// unregister removes a registered algorithm; used by tests
+func unregister(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, algKey(name))
+}
+
+// Algorithms returns the names of all registered algorithms, sorted
+func Algorithms() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for _, a := range registry {
+		names = append(names, a.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// algKey returns the registry key for an algorithm name. Case, hyphens,
+// underscores and slashes are ignored, so `SHA-256`, `sha256` and
+// `SHA512/256` are all recognized.
+func algKey(name string) string {
+	name = strings.ToLower(name)
+	return strings.NewReplacer(`-`, ``, `_`, ``, `/`, ``).Replace(name)
+}
+
+// NormalizeAlgName returns the registered name for alg
 func NormalizeAlgName(alg string) (string, error) {
-	alg = strings.Replace(alg, `-`, ``, 1)
-	alg = strings.ToLower(alg)
-	for _, a := range availableAlgs {
-		if a == alg {
-			return alg, nil
-		}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if a, ok := registry[algKey(alg)]; ok {
+		return a.name, nil
 	}
-	return ``, fmt.Errorf(`Unknown checksum algorithm: %s`, alg)
+	return ``, fmt.Errorf(`%w: %s`, ErrUnknownAlg, alg)
 }
 
 // NewHash returns Hash object for specified algorithm
 func NewHash(alg string) (hash.Hash, error) {
-	var h hash.Hash
-	switch alg {
-	case SHA512:
-		h = sha512.New()
-	case SHA256:
-		h = sha256.New()
-	case SHA224:
-		h = sha256.New224()
-	case SHA1:
-		h = sha1.New()
-	case MD5:
-		h = md5.New()
-	default:
-		return nil, fmt.Errorf(`Unknown checksum algorithm: %s`, alg)
+	registryMu.RLock()
+	a, ok := registry[algKey(alg)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf(`%w: %s`, ErrUnknownAlg, alg)
 	}
-	return h, nil
+	return a.newHash(), nil
 }
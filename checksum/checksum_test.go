@@ -2,6 +2,8 @@ package checksum
 
 import (
 	"errors"
+	"hash"
+	"hash/crc32"
 	"testing"
 
 	"github.com/srerickson/bago/backend"
@@ -17,17 +19,17 @@ func TestChecksumBasic(t *testing.T) {
 	for n := 1; n < 4; n++ {
 		results := []string{}
 		c := New(n, testBag(), func(push JobPusher) error {
-			push(Job{Path: `bagit.txt`, Alg: MD5})
-			push(Job{Path: `bag-info.txt`, Alg: SHA1})
-			push(Job{Path: `manifest-md5.txt`, Alg: SHA256})
-			push(Job{Path: `tagmanifest-md5.txt`, Alg: SHA512})
+			push(Job{Path: `bagit.txt`, Algs: []string{MD5}})
+			push(Job{Path: `bag-info.txt`, Algs: []string{SHA1}})
+			push(Job{Path: `manifest-md5.txt`, Algs: []string{SHA256}})
+			push(Job{Path: `tagmanifest-md5.txt`, Algs: []string{SHA512}})
 			return nil
 		})
 		for r := range c.Results() {
 			if r.Err != nil {
 				t.Errorf("unexpected error: %s", r.Err.Error())
 			}
-			results = append(results, r.SumString())
+			results = append(results, r.SumString(r.Algs[0]))
 		}
 		if len(results) != 4 {
 			t.Errorf("expected there to be 2 checksum result, not %v", len(results))
@@ -38,10 +40,10 @@ func TestChecksumBasic(t *testing.T) {
 func TestChecksumCancel(t *testing.T) {
 	results := []string{}
 	c := New(1, testBag(), func(push JobPusher) error {
-		push(Job{Path: `bagit.txt`, Alg: MD5})
-		push(Job{Path: `bag-info.txt`, Alg: MD5})
-		push(Job{Path: `manifest-md5.txt`, Alg: MD5})
-		push(Job{Path: `tagmanifest-md5.txt`, Alg: MD5})
+		push(Job{Path: `bagit.txt`, Algs: []string{MD5}})
+		push(Job{Path: `bag-info.txt`, Algs: []string{MD5}})
+		push(Job{Path: `manifest-md5.txt`, Algs: []string{MD5}})
+		push(Job{Path: `tagmanifest-md5.txt`, Algs: []string{MD5}})
 		return nil
 	})
 	go func() {
@@ -51,7 +53,7 @@ func TestChecksumCancel(t *testing.T) {
 		if r.Err != nil {
 			t.Errorf("unexpected error: %s", r.Err.Error())
 		}
-		results = append(results, r.SumString())
+		results = append(results, r.SumString(r.Algs[0]))
 	}
 	if len(results) >= 4 {
 		t.Errorf("expected fewer than four results, not %v", len(results))
@@ -61,14 +63,14 @@ func TestChecksumCancel(t *testing.T) {
 func TestChecksumPushError(t *testing.T) {
 	results := []string{}
 	c := New(1, testBag(), func(push JobPusher) error {
-		push(Job{Path: `bagit.txt`, Alg: MD5})
+		push(Job{Path: `bagit.txt`, Algs: []string{MD5}})
 		return errors.New("a problem")
 	})
 	for r := range c.Results() {
 		if r.Err != nil {
 			t.Errorf("unexpected error: %s", r.Err.Error())
 		}
-		results = append(results, r.SumString())
+		results = append(results, r.SumString(r.Algs[0]))
 	}
 	if len(results) != 1 {
 		t.Errorf("expected 1 result, not %v", len(results))
@@ -76,5 +78,112 @@ func TestChecksumPushError(t *testing.T) {
 	if e := <-c.PushError(); e == nil || e.Error() != `a problem` {
 		t.Error("expected to receive an error, not nil")
 	}
+	if e := c.Err(); e == nil || e.Error() != `a problem` {
+		t.Error("expected Err() to return the producer error")
+	}
+
+}
+
+func TestChecksumMultipleAlgs(t *testing.T) {
+	algs := []string{MD5, SHA1, SHA512}
+	single := map[string][]byte{}
+	c := New(1, testBag(), func(push JobPusher) error {
+		for _, alg := range algs {
+			push(Job{Path: `bagit.txt`, Algs: []string{alg}})
+		}
+		return nil
+	})
+	for r := range c.Results() {
+		single[r.Algs[0]] = r.Sums[r.Algs[0]]
+	}
+	c = New(1, testBag(), func(push JobPusher) error {
+		push(Job{Path: `bagit.txt`, Algs: algs, Expected: single})
+		return nil
+	})
+	n := 0
+	for r := range c.Results() {
+		n++
+		if r.Err != nil {
+			t.Errorf("unexpected error: %s", r.Err.Error())
+		}
+		if len(r.Sums) != len(algs) {
+			t.Errorf("expected %d sums, not %d", len(algs), len(r.Sums))
+		}
+		if !r.SumIsExpected() {
+			t.Errorf("sums for %v don't match: %v", algs, r.Mismatches())
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected 1 result, not %v", n)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register(`crc32-ieee`, func() hash.Hash { return crc32.NewIEEE() })
+	defer func() {
+		unregister(`crc32-ieee`)
+		if _, err := NormalizeAlgName(`crc32-ieee`); err == nil {
+			t.Error("expected crc32-ieee to be unregistered")
+		}
+	}()
+	for _, name := range []string{`crc32-ieee`, `CRC32-IEEE`, `crc32ieee`} {
+		alg, err := NormalizeAlgName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg != `crc32-ieee` {
+			t.Errorf("expected normalized name crc32-ieee, not %s", alg)
+		}
+		if _, err := NewHash(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		`SHA-256`:    SHA256,
+		`SHA512/256`: SHA512_256,
+		`sha384`:     SHA384,
+	} {
+		if alg, err := NormalizeAlgName(name); err != nil || alg != expected {
+			t.Errorf("expected %s to normalize to %s, got %s", name, expected, alg)
+		}
+	}
+	if _, err := NormalizeAlgName(`nope`); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
 
+func TestChecksumJobResults(t *testing.T) {
+	fi, err := testBag().Stat(`bagit.txt`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(1, testBag(), func(push JobPusher) error {
+		push(Job{Path: `bagit.txt`, Algs: []string{MD5}})
+		push(Job{Path: `missing.txt`, Algs: []string{MD5}})
+		push(Job{Path: `bagit.txt`, Algs: []string{`nope`}})
+		return nil
+	})
+	kinds := map[string]ErrorKind{}
+	for r := range c.Results() {
+		if r.Err == nil {
+			if r.Size != fi.Size() {
+				t.Errorf("expected size %d, got %d", fi.Size(), r.Size)
+			}
+			continue
+		}
+		jobErr, ok := r.Err.(*JobError)
+		if !ok {
+			t.Fatalf("expected a *JobError, got %T", r.Err)
+		}
+		kinds[r.Path] = jobErr.Kind
+	}
+	if kinds[`missing.txt`] != NotFoundError {
+		t.Errorf("expected NotFoundError, got %s", kinds[`missing.txt`])
+	}
+	if kinds[`bagit.txt`] != UnknownAlgError {
+		t.Errorf("expected UnknownAlgError, got %s", kinds[`bagit.txt`])
+	}
+	if c.Err() != nil {
+		t.Error(c.Err())
+	}
 }
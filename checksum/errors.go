@@ -0,0 +1,64 @@
+package checksum
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrUnknownAlg is returned for algorithms that haven't been registered
+var ErrUnknownAlg = errors.New(`Unknown checksum algorithm`)
+
+// ErrorKind classifies the cause of a JobError
+type ErrorKind int
+
+const (
+	IOError         ErrorKind = iota // error reading the file
+	NotFoundError                    // file does not exist
+	PermissionError                  // file could not be opened
+	UnknownAlgError                  // algorithm is not registered
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case NotFoundError:
+		return `not found`
+	case PermissionError:
+		return `permission denied`
+	case UnknownAlgError:
+		return `unknown algorithm`
+	}
+	return `i/o error`
+}
+
+// JobError is the error type set in Job.Err
+type JobError struct {
+	Kind ErrorKind
+	Path string
+	Err  error
+}
+
+func (e *JobError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// newJobError wraps err as a JobError, classifying it by its cause.
+func newJobError(path string, err error) *JobError {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return jobErr
+	}
+	kind := IOError
+	switch {
+	case errors.Is(err, ErrUnknownAlg):
+		kind = UnknownAlgError
+	case errors.Is(err, os.ErrNotExist):
+		kind = NotFoundError
+	case errors.Is(err, os.ErrPermission):
+		kind = PermissionError
+	}
+	return &JobError{Kind: kind, Path: path, Err: err}
+}
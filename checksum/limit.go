@@ -0,0 +1,81 @@
+package checksum
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLimitedRead is the largest read made through a Limiter, so that
+// bandwidth is shared evenly between workers.
+const maxLimitedRead = 64 * 1024
+
+// Limiter limits the rate at which files are read. A Limiter may be shared
+// by several Checksumers to give them a common bandwidth budget.
+type Limiter struct {
+	mu   sync.Mutex
+	rate float64   // bytes per second
+	next time.Time // when the next read may proceed
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSec bytes to be read per
+// second.
+func NewLimiter(bytesPerSec int64) *Limiter {
+	return &Limiter{rate: float64(bytesPerSec)}
+}
+
+// wait accounts for n bytes read, blocking until reads are within the limit.
+func (l *Limiter) wait(n int) {
+	if n <= 0 || l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// Reader returns a reader whose reads are limited by l
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.wait(n)
+	return n, err
+}
+
+// deviceLimit limits the number of concurrent reads on each storage device
+type deviceLimit struct {
+	mu   sync.Mutex
+	max  int
+	sems map[uint64]chan struct{}
+}
+
+// acquire blocks until a read slot on dev is available. It returns a
+// function that releases the slot.
+func (d *deviceLimit) acquire(dev uint64) func() {
+	d.mu.Lock()
+	sem, ok := d.sems[dev]
+	if !ok {
+		sem = make(chan struct{}, d.max)
+		d.sems[dev] = sem
+	}
+	d.mu.Unlock()
+	sem <- struct{}{}
+	return func() { <-sem }
+}
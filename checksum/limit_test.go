@@ -0,0 +1,65 @@
+package checksum
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(1024 * 1024)
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, l.Reader(bytes.NewReader(make([]byte, 256*1024))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 256*1024 {
+		t.Errorf("expected to read %d bytes, not %d", 256*1024, n)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("read was not limited: took %s", elapsed)
+	}
+}
+
+func TestDeviceLimit(t *testing.T) {
+	d := &deviceLimit{max: 2, sems: map[uint64]chan struct{}{}}
+	release := d.acquire(1)
+	d.acquire(1)
+	d.acquire(2) // other devices are not affected
+	acquired := make(chan struct{})
+	go func() {
+		d.acquire(1)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to block at the device limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected acquire to proceed after release")
+	}
+}
+
+func TestChecksumWithLimits(t *testing.T) {
+	c := New(4, testBag(), func(push JobPusher) error {
+		push(Job{Path: `bagit.txt`, Algs: []string{MD5}})
+		push(Job{Path: `bag-info.txt`, Algs: []string{MD5}})
+		return nil
+	}, WithRateLimit(1024*1024), WithDeviceLimit(1))
+	n := 0
+	for r := range c.Results() {
+		n++
+		if r.Err != nil {
+			t.Error(r.Err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 results, not %d", n)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build go1.24
+// +build go1.24
+
+package checksum
+
+import (
+	"crypto/sha3"
+	"hash"
+)
+
+// SHA-3 is part of the standard library as of Go 1.24
+func init() {
+	Register(SHA3_512, func() hash.Hash { return sha3.New512() })
+	Register(SHA3_384, func() hash.Hash { return sha3.New384() })
+	Register(SHA3_256, func() hash.Hash { return sha3.New256() })
+	Register(SHA3_224, func() hash.Hash { return sha3.New224() })
+}
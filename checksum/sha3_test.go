@@ -0,0 +1,18 @@
+//go:build go1.24
+// +build go1.24
+
+package checksum
+
+import "testing"
+
+func TestSHA3Registered(t *testing.T) {
+	for _, name := range []string{`sha3-256`, `SHA3-256`, `sha3256`} {
+		alg, err := NormalizeAlgName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if alg != SHA3_256 {
+			t.Errorf("expected %s, got %s", SHA3_256, alg)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package checksum
+
+import "os"
+
+// fileID is not supported on this platform
+func fileID(fi os.FileInfo) (dev uint64, ino uint64, ok bool) {
+	return 0, 0, false
+}
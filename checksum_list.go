@@ -0,0 +1,171 @@
+package bago
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/srerickson/bago/checksum"
+)
+
+// ChecksumFormat is a format for lists of checksums
+type ChecksumFormat int
+
+const (
+	BagItFormat     ChecksumFormat = iota // manifest lines: <hex> <path>
+	CoreutilsFormat                       // sha256sum and md5sum: <hex>  <path>
+	BSDFormat                             // BSD and --tag output: SHA256 (<path>) = <hex>
+)
+
+func (f ChecksumFormat) String() string {
+	switch f {
+	case CoreutilsFormat:
+		return `coreutils`
+	case BSDFormat:
+		return `bsd`
+	}
+	return `bagit`
+}
+
+// ParseChecksumFormat parses the name of a ChecksumFormat
+func ParseChecksumFormat(name string) (ChecksumFormat, error) {
+	for _, f := range []ChecksumFormat{BagItFormat, CoreutilsFormat, BSDFormat} {
+		if strings.EqualFold(name, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown checksum format: %s", name)
+}
+
+var (
+	coreutilsLineRE = regexp.MustCompile(`^(\\?)([0-9a-fA-F]+) [ *]?(.+)$`)
+	bsdLineRE       = regexp.MustCompile(`^(\\?)([\w/-]+) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+)
+
+// sumLengthAlgs are the algorithms assumed for coreutils-style checksums
+// of each length, in hex digits, if no algorithm is given
+var sumLengthAlgs = map[int]string{
+	32:  checksum.MD5,
+	40:  checksum.SHA1,
+	56:  checksum.SHA224,
+	64:  checksum.SHA256,
+	96:  checksum.SHA384,
+	128: checksum.SHA512,
+}
+
+// ReadChecksums reads a list of checksums in coreutils format (as written by
+// sha256sum, md5sum and others, with or without the '*' binary marker), BSD
+// format (as written by BSD md5/sha256 and 'sha256sum --tag') or BagIt
+// manifest format. The formats may be mixed. Lines in BSD format name their
+// algorithm; for other lines, alg is used if given, otherwise the algorithm
+// is guessed from the checksum's length. A payload manifest is returned for
+// each algorithm, with paths as listed.
+func ReadChecksums(reader io.Reader, alg string) ([]*Manifest, error) {
+	if alg != `` {
+		var err error
+		if alg, err = checksum.NormalizeAlgName(alg); err != nil {
+			return nil, err
+		}
+	}
+	mans := map[string]*Manifest{}
+	var algs []string
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		var escaped bool
+		var lineAlg, name, sum string
+		if match := bsdLineRE.FindStringSubmatch(line); match != nil {
+			escaped, name, sum = match[1] != ``, match[3], match[4]
+			var err error
+			if lineAlg, err = checksum.NormalizeAlgName(match[2]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+			}
+		} else if match := coreutilsLineRE.FindStringSubmatch(line); match != nil {
+			escaped, sum, name = match[1] != ``, match[2], match[3]
+			if lineAlg = alg; lineAlg == `` {
+				if lineAlg = sumLengthAlgs[len(sum)]; lineAlg == `` {
+					return nil, fmt.Errorf("line %d: can't determine algorithm for checksum", lineNum)
+				}
+			}
+		} else {
+			return nil, fmt.Errorf("Syntax error at line: %d", lineNum)
+		}
+		if escaped {
+			name = unescapeChecksumPath(name)
+		}
+		name = path.Clean(strings.TrimPrefix(name, `./`))
+		if name == `..` || strings.HasPrefix(name, `../`) || path.IsAbs(name) {
+			return nil, fmt.Errorf("Out of scope path at line: %d", lineNum)
+		}
+		decoded, err := hex.DecodeString(sum)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+		man, exists := mans[lineAlg]
+		if !exists {
+			man = &Manifest{algorithm: lineAlg}
+			mans[lineAlg] = man
+			algs = append(algs, lineAlg)
+		}
+		if err = man.Append(EncodePath(name), decoded); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(algs)
+	ret := make([]*Manifest, len(algs))
+	for i, alg := range algs {
+		ret[i] = mans[alg]
+	}
+	return ret, nil
+}
+
+// WriteFormat writes the manifest in format. Paths are relative to the
+// bag, so the output can be checked from the bag's directory with, for
+// example, 'sha256sum -c'.
+func (man *Manifest) WriteFormat(writer io.Writer, format ChecksumFormat) error {
+	if format == BagItFormat {
+		return man.Write(writer)
+	}
+	for _, entry := range man.Entries() {
+		name, escaped := escapeChecksumPath(entry.path)
+		var prefix string
+		if escaped {
+			prefix = `\`
+		}
+		var err error
+		if format == BSDFormat {
+			_, err = fmt.Fprintf(writer, "%s%s (%s) = %s\n", prefix,
+				strings.ToUpper(man.algorithm), name, entry.HexSum())
+		} else {
+			_, err = fmt.Fprintf(writer, "%s%s  %s\n", prefix, entry.HexSum(), name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeChecksumPath escapes backslashes and newlines in p the way
+// coreutils does. It returns false if p didn't need escaping.
+func escapeChecksumPath(p string) (string, bool) {
+	if !strings.ContainsAny(p, "\\\n\r") {
+		return p, false
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(p), true
+}
+
+func unescapeChecksumPath(p string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(p)
+}
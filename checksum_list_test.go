@@ -0,0 +1,116 @@
+package bago
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+func TestReadChecksums(t *testing.T) {
+	input := strings.Join([]string{
+		`# comment`,
+		`b1946ac92492d2347c6235b4d2611184 *data/hello.txt`,
+		`d41d8cd98f00b204e9800998ecf8427e  ./data/empty.txt`,
+		`\d41d8cd98f00b204e9800998ecf8427e  data/back\\slash\nnewline.txt`,
+		`SHA256 (data/hello.txt) = 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03`,
+		``,
+	}, "\n")
+	mans, err := ReadChecksums(strings.NewReader(input), ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mans) != 2 || mans[0].Algorithm() != `md5` || mans[1].Algorithm() != `sha256` {
+		t.Fatalf("unexpected manifests: %v", mans)
+	}
+	for _, p := range []string{`data/hello.txt`, `data/empty.txt`, "data/back\\slash\nnewline.txt"} {
+		if _, exists := mans[0].Lookup(p); !exists {
+			t.Errorf("expected md5 entry for %q", p)
+		}
+	}
+	if entry, _ := mans[1].Lookup(`data/hello.txt`); !strings.HasPrefix(entry.HexSum(), `5891b5b5`) {
+		t.Errorf("unexpected sha256 entry: %v", entry)
+	}
+
+	// round trip
+	for _, format := range []ChecksumFormat{CoreutilsFormat, BSDFormat} {
+		var out strings.Builder
+		if err := mans[0].WriteFormat(&out, format); err != nil {
+			t.Fatal(err)
+		}
+		again, err := ReadChecksums(strings.NewReader(out.String()), `md5`)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if len(again) != 1 || again[0].Len() != mans[0].Len() {
+			t.Errorf("%s: round trip failed: %q", format, out.String())
+		}
+	}
+
+	for _, bad := range []string{
+		`b1946ac92492d2347c6235b4d2611184`,
+		`b1946ac9 data/hello.txt`,
+		`b1946ac92492d2347c6235b4d2611184  ../hello.txt`,
+		`NOPE (data/hello.txt) = b1946ac92492d2347c6235b4d2611184`,
+		"b1946ac92492d2347c6235b4d2611184  a\nb1946ac92492d2347c6235b4d2611184  a",
+	} {
+		if _, err := ReadChecksums(strings.NewReader(bad), ``); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	// md5sum output in the manifest of a warning fixture
+	file, err := os.Open(test.Path([]string{`bags`, `v0.97`, `warning`, `made-with-md5sum-tools`, `manifest-md5.txt`}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if mans, err = ReadChecksums(file, `md5`); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := mans[0].Lookup(`data/hello.txt`); !exists {
+		t.Error("expected an entry for data/hello.txt")
+	}
+}
+
+func TestCreateBagTrustedSums(t *testing.T) {
+	fileContent := map[string][]byte{
+		`hello.txt`:      []byte("hello\n"),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+	}
+	sums := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03 *hello.txt\n"
+	for _, tcase := range []struct {
+		lists []string
+		valid bool
+	}{
+		{[]string{sums}, true},
+		{[]string{strings.Replace(sums, `5891`, `0000`, 1)}, false},
+		{[]string{strings.Replace(sums, `hello.txt`, `missing.txt`, 1)}, false},
+		// paths relative to the bag
+		{[]string{strings.Replace(sums, `*hello.txt`, `data/hello.txt`, 1)}, true},
+		{[]string{sums, strings.Replace(sums, `*hello.txt`, `data/hello.txt`, 1)}, true},
+		// lists that disagree
+		{[]string{sums, strings.Replace(sums, `5891`, `0000`, 1)}, false},
+	} {
+		var trusted []*Manifest
+		for _, list := range tcase.lists {
+			mans, err := ReadChecksums(strings.NewReader(list), ``)
+			if err != nil {
+				t.Fatal(err)
+			}
+			trusted = append(trusted, mans...)
+		}
+		src := test.TmpDataPath(fileContent)
+		defer os.RemoveAll(src)
+		_, err := CreateBag(&CreateBagOptions{
+			SrcDir:      src,
+			InPlace:     true,
+			Algorithms:  []string{`md5`},
+			TrustedSums: trusted,
+		})
+		if (err == nil) != tcase.valid {
+			t.Errorf("unexpected result for trusted sums %q: %v", tcase.lists, err)
+		}
+	}
+}
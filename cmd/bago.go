@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/integrii/flaggy"
 	"github.com/srerickson/bago"
+	"github.com/srerickson/bago/backend"
 	"github.com/srerickson/bago/checksum"
 )
 
@@ -21,6 +27,8 @@ var greenOK = colorGreen + "[OK]" + colorReset
 
 var version = "unknown"
 var subCmd = make(map[string]*flaggy.Subcommand)
+var manifestCmd = make(map[string]*flaggy.Subcommand) // manifest subcommands
+var tagCmd = make(map[string]*flaggy.Subcommand)      // tag subcommands
 
 // default parameters
 var processes = runtime.GOMAXPROCS(0)
@@ -29,6 +37,33 @@ var algorithms = []string{checksum.SHA512}
 var path = `./`
 var outPath = ``
 var tags = []string{}
+var cachePath = ``
+var rehash = false
+var rateLimit = ``
+var deviceProcs = 0
+var bagDate = ``
+var createMode = `move`
+var sources = []string{}
+var fileList = ``
+var includes = []string{}
+var excludes = []string{}
+var dryRun = false
+var symlinks = ``
+var skipHidden = false
+var special = ``
+var preserveMetadata = false
+var tagEncoding = ``
+var trustedSums = []string{}
+var sumFormat = `coreutils`
+var exportTag = false
+var againstPath = ``
+var manifestPolicy = `all`
+var relativeTo = `guess`
+var restoreOwners = false
+var payloadArgs [2]string
+var manifestAlg = ``
+var tagLabel = ``
+var tagValue = ``
 
 func init() {
 	flaggy.SetName("bago")
@@ -37,18 +72,123 @@ func init() {
 	// global flags
 	flaggy.Int(&processes, `p`, `procs`, `number of goroutines allocated for checksum`)
 	flaggy.Bool(&verbose, `v`, `verbose`, `verbose validation`)
+	flaggy.String(&rateLimit, `l`, `limit`, `max read rate for checksums, in bytes per second (e.g. 500K, 20M)`)
+	flaggy.Int(&deviceProcs, `d`, `device-procs`, `max concurrent reads per storage device`)
 
 	// validate subcommand
 	subCmd[`validate`] = flaggy.NewSubcommand("validate")
 	subCmd[`validate`].Description = "Validate a Bag"
 	subCmd[`validate`].AddPositionalValue(&path, `path`, 1, true, `bag to validate`)
+	subCmd[`validate`].String(&manifestPolicy, `P`, `manifest-policy`, `payload manifests that must list each file: all or any`)
 
 	// create subcommand
 	subCmd[`create`] = flaggy.NewSubcommand("create")
-	subCmd[`create`].Description = "Create a Bag"
+	subCmd[`create`].Description = "Create a Bag, or resume an interrupted one"
 	subCmd[`create`].AddPositionalValue(&path, `path`, 1, true, `folder to bag`)
 	subCmd[`create`].String(&outPath, `o`, `output`, `destination for new bag`)
-	subCmd[`create`].StringSlice(&algorithms, `a`, `algs`, `checksum algorithms`)
+	subCmd[`create`].String(&createMode, `m`, `mode`, `how files are put in the bag: move, copy, link or reflink`)
+	subCmd[`create`].StringSlice(&sources, `s`, `source`, `additional payload source, as path or path=target`)
+	subCmd[`create`].String(&fileList, `f`, `files`, `file listing paths (relative to the bagged folder) to include`)
+	subCmd[`create`].StringSlice(&includes, `i`, `include`, `only include files matching this pattern`)
+	subCmd[`create`].StringSlice(&excludes, `x`, `exclude`, `exclude files matching this pattern (e.g. .DS_Store)`)
+	subCmd[`create`].Bool(&dryRun, `n`, `dry-run`, `list payload files without creating the bag`)
+	subCmd[`create`].String(&bagDate, `D`, `date`, `Bagging-Date for the new bag (YYYY-MM-DD), for reproducible output`)
+	subCmd[`create`].Bool(&preserveMetadata, `M`, `metadata`, `record modification times, permissions and owners in a tag file`)
+	subCmd[`create`].StringSlice(&trustedSums, `t`, `trusted`, `checksum list (sha256sum or BSD format) to verify payload files against`)
+	subCmd[`create`].String(&tagEncoding, `E`, `encoding`, `character encoding for tag files, e.g. ISO-8859-1 or UTF-16 (default UTF-8)`)
+	subCmd[`create`].StringSlice(&algorithms, `a`, `algs`,
+		`checksum algorithms: `+strings.Join(checksum.Algorithms(), `, `))
+
+	// recover subcommand
+	subCmd[`recover`] = flaggy.NewSubcommand("recover")
+	subCmd[`recover`].Description = "Roll back an interrupted bag creation"
+	subCmd[`recover`].AddPositionalValue(&path, `path`, 1, true, `folder that was being bagged`)
+
+	// restore-metadata subcommand
+	subCmd[`restore-metadata`] = flaggy.NewSubcommand("restore-metadata")
+	subCmd[`restore-metadata`].Description = "Reapply recorded file metadata and recreate empty directories"
+	subCmd[`restore-metadata`].AddPositionalValue(&path, `path`, 1, true, `bag with recorded metadata`)
+	subCmd[`restore-metadata`].String(&outPath, `o`, `output`, `directory the payload was extracted to (default: the bag's data directory)`)
+	subCmd[`restore-metadata`].Bool(&restoreOwners, `O`, `owners`, `also restore file owners`)
+
+	// update subcommand
+	subCmd[`update`] = flaggy.NewSubcommand("update")
+	subCmd[`update`].Description = "Update a Bag's manifests after changes in its payload directory"
+	subCmd[`update`].AddPositionalValue(&path, `path`, 1, true, `bag to update`)
+	subCmd[`update`].Bool(&rehash, `r`, `rehash`, `rehash every file, not only files that appear to have changed`)
+
+	// verify subcommand
+	subCmd[`verify`] = flaggy.NewSubcommand("verify")
+	subCmd[`verify`].Description = "Compare a Bag's payload with an external checksum list"
+	subCmd[`verify`].AddPositionalValue(&path, `path`, 1, true, `bag to verify`)
+	subCmd[`verify`].String(&againstPath, `A`, `against`, `checksum list (manifest, sha256sum or BSD format)`)
+	subCmd[`verify`].String(&manifestAlg, `a`, `alg`, `algorithm of the checksum list, if it doesn't name one`)
+	subCmd[`verify`].String(&relativeTo, `r`, `relative-to`, `what paths in the checksum list are relative to: bag, payload or guess`)
+
+	// convert-encoding subcommand
+	subCmd[`convert-encoding`] = flaggy.NewSubcommand("convert-encoding")
+	subCmd[`convert-encoding`].Description = "Rewrite a Bag's tag files in another character encoding"
+	subCmd[`convert-encoding`].AddPositionalValue(&path, `path`, 1, true, `bag to convert`)
+	subCmd[`convert-encoding`].AddPositionalValue(&tagEncoding, `encoding`, 2, true, `new encoding, e.g. UTF-8`)
+
+	// payload editing subcommands
+	subCmd[`add`] = flaggy.NewSubcommand("add")
+	subCmd[`add`].Description = "Add a file to a bag's payload"
+	subCmd[`add`].AddPositionalValue(&path, `path`, 1, true, `bag to change`)
+	subCmd[`add`].AddPositionalValue(&payloadArgs[0], `file`, 2, true, `file to add`)
+	subCmd[`add`].AddPositionalValue(&payloadArgs[1], `dest`, 3, true, `path for the file, relative to data/`)
+	subCmd[`rm`] = flaggy.NewSubcommand("rm")
+	subCmd[`rm`].Description = "Remove a file from a bag's payload"
+	subCmd[`rm`].AddPositionalValue(&path, `path`, 1, true, `bag to change`)
+	subCmd[`rm`].AddPositionalValue(&payloadArgs[0], `file`, 2, true, `file to remove, relative to data/`)
+	subCmd[`mv`] = flaggy.NewSubcommand("mv")
+	subCmd[`mv`].Description = "Rename a file in a bag's payload"
+	subCmd[`mv`].AddPositionalValue(&path, `path`, 1, true, `bag to change`)
+	subCmd[`mv`].AddPositionalValue(&payloadArgs[0], `from`, 2, true, `file to rename, relative to data/`)
+	subCmd[`mv`].AddPositionalValue(&payloadArgs[1], `to`, 3, true, `new path, relative to data/`)
+
+	// manifest subcommands
+	subCmd[`manifest`] = flaggy.NewSubcommand("manifest")
+	subCmd[`manifest`].Description = "Add or remove a Bag's manifests"
+	manifestCmd[`add`] = flaggy.NewSubcommand("add")
+	manifestCmd[`add`].Description = "Verify a Bag and add manifests for an algorithm"
+	manifestCmd[`remove`] = flaggy.NewSubcommand("remove")
+	manifestCmd[`remove`].Description = "Remove the manifests for an algorithm"
+	manifestCmd[`export`] = flaggy.NewSubcommand("export")
+	manifestCmd[`export`].Description = "Print a manifest in another checksum format"
+	manifestCmd[`export`].String(&sumFormat, `f`, `format`, `output format: coreutils, bsd or bagit`)
+	manifestCmd[`export`].Bool(&exportTag, `T`, `tag`, `export the tag manifest instead of the payload manifest`)
+	for _, sc := range manifestCmd {
+		sc.AddPositionalValue(&path, `path`, 1, true, `bag to change`)
+		sc.AddPositionalValue(&manifestAlg, `alg`, 2, true, `checksum algorithm`)
+		subCmd[`manifest`].AttachSubcommand(sc, 1)
+	}
+
+	// tag subcommands
+	subCmd[`tag`] = flaggy.NewSubcommand("tag")
+	subCmd[`tag`].Description = "Edit a Bag's bag-info.txt"
+	tagCmd[`set`] = flaggy.NewSubcommand("set")
+	tagCmd[`set`].Description = "Replace a tag's values"
+	tagCmd[`add`] = flaggy.NewSubcommand("add")
+	tagCmd[`add`].Description = "Add a value for a tag"
+	tagCmd[`rm`] = flaggy.NewSubcommand("rm")
+	tagCmd[`rm`].Description = "Remove a tag"
+	for name, sc := range tagCmd {
+		sc.AddPositionalValue(&path, `path`, 1, true, `bag to change`)
+		sc.AddPositionalValue(&tagLabel, `label`, 2, true, `tag label`)
+		if name != `rm` {
+			sc.AddPositionalValue(&tagValue, `value`, 3, true, `tag value`)
+		}
+		subCmd[`tag`].AttachSubcommand(sc, 1)
+	}
+
+	for _, sc := range []*flaggy.Subcommand{subCmd[`validate`], subCmd[`create`]} {
+		sc.String(&cachePath, `c`, `cache`, `checksum cache file`)
+		sc.Bool(&rehash, `r`, `rehash`, `rehash files even if cached checksums are current`)
+		sc.String(&symlinks, `L`, `symlinks`, `how symbolic links are handled: skip, follow, preserve or reject`)
+		sc.Bool(&skipHidden, `H`, `skip-hidden`, `leave out files and directories starting with '.'`)
+		sc.String(&special, `S`, `special`, `how special files (pipes, sockets, devices) are handled: skip or reject`)
+	}
 
 	for i := range subCmd {
 		flaggy.AttachSubcommand(subCmd[i], 1)
@@ -57,35 +197,441 @@ func init() {
 	flaggy.Parse()
 }
 
+// openedCache is closed by fatal and fatalf, which exit without running
+// deferred calls
+var openedCache *checksum.FileCache
+
+// fatal is log.Fatal, saving the checksum cache first
+func fatal(v ...interface{}) {
+	if openedCache != nil {
+		openedCache.Close()
+	}
+	log.Fatal(v...)
+}
+
+// fatalf is log.Fatalf, saving the checksum cache first
+func fatalf(format string, v ...interface{}) {
+	if openedCache != nil {
+		openedCache.Close()
+	}
+	log.Fatalf(format, v...)
+}
+
+// openCache opens the checksum cache file given on the command line, if any
+func openCache() (*checksum.FileCache, checksum.CachePolicy) {
+	policy := checksum.TrustCache
+	if rehash {
+		policy = checksum.AlwaysRehash
+	}
+	if cachePath == `` {
+		return nil, policy
+	}
+	cache, err := checksum.OpenFileCache(cachePath)
+	if err != nil {
+		log.Fatalf(`Could not open checksum cache: %s`, err.Error())
+	}
+	return cache, policy
+}
+
+// walkPolicy returns the walk policy given on the command line, and whether
+// any policy flag was used
+func walkPolicy() (policy backend.WalkPolicy, set bool, err error) {
+	if symlinks != `` {
+		if policy.Symlinks, err = backend.ParseSymlinkPolicy(symlinks); err != nil {
+			return
+		}
+	}
+	if special != `` {
+		if policy.Special, err = backend.ParseSpecialPolicy(special); err != nil {
+			return
+		}
+	}
+	policy.SkipHidden = skipHidden
+	set = symlinks != `` || special != `` || skipHidden
+	return
+}
+
+// parseRate parses a byte rate with an optional K, M or G suffix
+func parseRate(s string) (int64, error) {
+	if s == `` {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case `K`:
+		mult = 1 << 10
+	case `M`:
+		mult = 1 << 20
+	case `G`:
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf(`invalid rate: %s`, s)
+	}
+	return n * mult, nil
+}
+
+// readLines returns the non-empty lines of a file, ignoring '#' comments
+func readLines(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != `` && !strings.HasPrefix(line, `#`) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// readTrusted reads the checksum lists given with --trusted
+func readTrusted() ([]*bago.Manifest, error) {
+	var ret []*bago.Manifest
+	for _, name := range trustedSums {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		mans, err := bago.ReadChecksums(file, ``)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf(`%s: %s`, name, err.Error())
+		}
+		ret = append(ret, mans...)
+	}
+	return ret, nil
+}
+
+// exportManifest prints the bag's manifest for alg in the --format format
+func exportManifest(bag *bago.Bag, alg string) error {
+	format, err := bago.ParseChecksumFormat(sumFormat)
+	if err != nil {
+		return err
+	}
+	if alg, err = checksum.NormalizeAlgName(alg); err != nil {
+		return err
+	}
+	var mans []*bago.Manifest
+	if exportTag {
+		mans = bag.TagManifests()
+	} else if mans, err = bag.Manifests(); err != nil {
+		return err
+	}
+	for _, man := range mans {
+		if man.Algorithm() == alg {
+			return man.WriteFormat(os.Stdout, format)
+		}
+	}
+	return fmt.Errorf(`bag has no %s manifest`, alg)
+}
+
+// payloadSources parses --source values
+func payloadSources() []bago.PayloadSource {
+	var ret []bago.PayloadSource
+	for _, src := range sources {
+		source := bago.PayloadSource{Path: src}
+		if i := strings.LastIndex(src, `=`); i > 0 {
+			source.Path, source.Target = src[:i], src[i+1:]
+		}
+		ret = append(ret, source)
+	}
+	return ret
+}
+
 func main() {
+	cache, policy := openCache()
+	if cache != nil {
+		openedCache = cache
+		defer cache.Close()
+	}
+	rate, err := parseRate(rateLimit)
+	if err != nil {
+		fatal(err)
+	}
+	walk, walkSet, err := walkPolicy()
+	if err != nil {
+		fatal(err)
+	}
 
 	if subCmd[`create`].Used {
 		opts := bago.CreateBagOptions{
 			SrcDir: path,
 			// Info:       bago.TagFile(tags),
-			DstPath:    outPath,
-			Algorithms: algorithms,
-			Workers:    processes,
-			InPlace:    outPath == ``,
+			DstPath:     outPath,
+			Algorithms:  algorithms,
+			Workers:     processes,
+			InPlace:     outPath == ``,
+			CachePolicy: policy,
+
+			RateLimit:     rate,
+			DeviceWorkers: deviceProcs,
+		}
+		if cache != nil {
+			opts.Cache = cache
+		}
+		if opts.Mode, err = bago.ParseCreateMode(createMode); err != nil {
+			fatal(err)
+		}
+		opts.Sources = payloadSources()
+		opts.Include = includes
+		opts.Exclude = excludes
+		opts.WalkPolicy = walk
+		opts.PreserveMetadata = preserveMetadata
+		opts.Encoding = tagEncoding
+		if opts.TrustedSums, err = readTrusted(); err != nil {
+			fatalf(`Could not read trusted checksums: %s`, err.Error())
 		}
-		_, err := bago.CreateBag(&opts)
+		if fileList != `` {
+			if opts.Files, err = readLines(fileList); err != nil {
+				fatalf(`Could not read file list: %s`, err.Error())
+			}
+		}
+		if dryRun {
+			plan, err := bago.PlanPayload(&opts)
+			if err != nil {
+				fatal(err)
+			}
+			for _, entry := range plan.Entries {
+				fmt.Printf("%12d  data/%s\n", entry.Size, entry.Dst)
+			}
+			fmt.Printf("%d files, %d bytes\n", len(plan.Entries), plan.TotalSize)
+			return
+		}
+		if bagDate != `` {
+			if opts.Date, err = time.Parse(`2006-01-02`, bagDate); err != nil {
+				fatalf(`Invalid date: %s`, bagDate)
+			}
+		}
+		_, err = bago.CreateBag(&opts)
 		if err != nil {
-			log.Fatalf(`Could not create bag: %s`, err.Error())
+			fatalf(`Could not create bag: %s`, err.Error())
 		}
 		fmt.Println(`Created new bag`)
 	}
 
-	if subCmd[`validate`].Used {
+	if subCmd[`recover`].Used {
+		if err := bago.RecoverBag(path); err != nil {
+			fatalf(`Could not recover: %s`, err.Error())
+		}
+		fmt.Println(`Recovered ` + path)
+	}
+
+	if subCmd[`add`].Used || subCmd[`rm`].Used || subCmd[`mv`].Used {
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		switch {
+		case subCmd[`add`].Used:
+			err = bag.AddPayload(payloadArgs[0], payloadArgs[1])
+		case subCmd[`rm`].Used:
+			err = bag.RemovePayload(payloadArgs[0])
+		case subCmd[`mv`].Used:
+			err = bag.RenamePayload(payloadArgs[0], payloadArgs[1])
+		}
+		if err != nil {
+			fatalf(`Could not change payload: %s`, err.Error())
+		}
+		fmt.Println(`Updated ` + path)
+	}
+
+	if subCmd[`update`].Used {
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		summary, err := bag.Update(&bago.UpdateOptions{
+			Workers:       processes,
+			Rehash:        rehash,
+			RateLimit:     rate,
+			DeviceWorkers: deviceProcs,
+		})
+		if err != nil {
+			fatalf(`Could not update bag: %s`, err.Error())
+		}
+		for _, p := range summary.Added {
+			fmt.Println(`added:    ` + p)
+		}
+		for _, p := range summary.Modified {
+			fmt.Println(`modified: ` + p)
+		}
+		for _, p := range summary.Removed {
+			fmt.Println(`removed:  ` + p)
+		}
+		for _, p := range summary.Repaired {
+			fmt.Println(`repaired: ` + p)
+		}
+		fmt.Printf("%d added, %d modified, %d removed, %d repaired\n",
+			len(summary.Added), len(summary.Modified), len(summary.Removed), len(summary.Repaired))
+	}
+
+	if subCmd[`verify`].Used {
+		if againstPath == `` {
+			flaggy.ShowHelpAndExit(`--against is required`)
+		}
+		rel, err := bago.ParseRelativeTo(relativeTo)
+		if err != nil {
+			fatal(err)
+		}
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		file, err := os.Open(againstPath)
+		if err != nil {
+			fatal(err)
+		}
+		external, err := bago.ReadChecksums(file, manifestAlg)
+		file.Close()
+		if err != nil {
+			fatalf(`Could not read %s: %s`, againstPath, err.Error())
+		}
+		ok := len(external) > 0
+		for _, man := range external {
+			report, err := bag.VerifyAgainst(man, &bago.ValidateOptions{
+				Workers:       processes,
+				RateLimit:     rate,
+				DeviceWorkers: deviceProcs,
+				RelativeTo:    rel,
+			})
+			if err != nil {
+				fatalf(`Could not verify bag: %s`, err.Error())
+			}
+			for _, p := range report.Extra {
+				fmt.Println(`extra:    ` + p)
+			}
+			for _, p := range report.Missing {
+				fmt.Println(`missing:  ` + p)
+			}
+			for _, p := range report.Mismatched {
+				fmt.Println(`mismatch: ` + p)
+			}
+			fmt.Printf("%s: %d extra, %d missing, %d mismatched\n", report.Algorithm,
+				len(report.Extra), len(report.Missing), len(report.Mismatched))
+			ok = ok && report.OK()
+		}
+		if !ok {
+			fatalf("%s Bag doesn't match %s", redErr, againstPath)
+		}
+		log.Printf("%s Bag matches %s", greenOK, againstPath)
+	}
+
+	if subCmd[`convert-encoding`].Used {
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		if err = bag.ConvertEncoding(tagEncoding); err != nil {
+			fatalf(`Could not convert bag: %s`, err.Error())
+		}
+		fmt.Println(`Updated ` + path)
+	}
+
+	if subCmd[`manifest`].Used {
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		switch {
+		case manifestCmd[`add`].Used:
+			err = bag.AddManifest(manifestAlg, &bago.ValidateOptions{
+				Workers:       processes,
+				RateLimit:     rate,
+				DeviceWorkers: deviceProcs,
+			})
+		case manifestCmd[`remove`].Used:
+			err = bag.RemoveManifest(manifestAlg)
+		case manifestCmd[`export`].Used:
+			if err = exportManifest(bag, manifestAlg); err != nil {
+				fatalf(`Could not export manifest: %s`, err.Error())
+			}
+			return
+		default:
+			flaggy.ShowHelpAndExit(`manifest subcommand required`)
+		}
+		if err != nil {
+			fatalf(`Could not change manifests: %s`, err.Error())
+		}
+		fmt.Println(`Updated ` + path)
+	}
+
+	if subCmd[`tag`].Used {
+		bag, err := bago.OpenBag(path)
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		switch {
+		case tagCmd[`set`].Used:
+			bag.Info.Set(tagLabel, tagValue)
+		case tagCmd[`add`].Used:
+			bag.Info.Append(tagLabel, tagValue)
+		case tagCmd[`rm`].Used:
+			if !bag.Info.Delete(tagLabel) {
+				fatalf(`No %s tag in bag-info.txt`, tagLabel)
+			}
+		default:
+			flaggy.ShowHelpAndExit(`tag subcommand required`)
+		}
+		if err = bag.SaveTags(); err != nil {
+			fatalf(`Could not save tags: %s`, err.Error())
+		}
+		fmt.Println(`Updated ` + path)
+	}
+
+	if subCmd[`restore-metadata`].Used {
 		bag, err := bago.OpenBag(path)
 		if err != nil {
-			log.Fatalf(`%s Not a bag: %s`, redErr, path)
+			fatalf(`%s Not a bag: %s`, redErr, path)
 		}
-		if _, err := bag.IsValidConcurrent(processes); err != nil {
+		err = bag.RestoreMetadata(&bago.RestoreOptions{Dir: outPath, Owners: restoreOwners})
+		if err != nil {
+			fatalf(`Could not restore metadata: %s`, err.Error())
+		}
+		fmt.Println(`Restored metadata for ` + path)
+	}
+
+	if subCmd[`validate`].Used {
+		var bag *bago.Bag
+		if walkSet {
+			bag, err = bago.OpenBagWithPolicy(path, walk)
+		} else {
+			bag, err = bago.OpenBag(path)
+		}
+		if err != nil {
+			fatalf(`%s Not a bag: %s`, redErr, path)
+		}
+		opts := bago.ValidateOptions{
+			Workers:       processes,
+			CachePolicy:   policy,
+			RateLimit:     rate,
+			DeviceWorkers: deviceProcs,
+		}
+		if cache != nil {
+			opts.Cache = cache
+		}
+		if opts.ManifestPolicy, err = bago.ParseManifestPolicy(manifestPolicy); err != nil {
+			fatal(err)
+		}
+		err = bag.Validate(&opts)
+		if verbose {
+			// after validating, so streamed payloads have been listed
+			for _, f := range bag.Findings().Warnings() {
+				log.Println(f.String())
+			}
+		}
+		if err != nil {
 			if verbose {
-				log.Fatalf("%s Bag is invalid: %s\n Errors:%s", redErr, path, err.Error())
+				fatalf("%s Bag is invalid: %s\n Errors:%s", redErr, path, err.Error())
 				return
 			}
-			log.Fatalf("%s Bag is invalid: %s", redErr, path)
+			fatalf("%s Bag is invalid: %s", redErr, path)
 		}
 		log.Printf("%s Bag is valid: %s", greenOK, path)
 	}
@@ -7,8 +7,10 @@ import (
 	"regexp"
 	"strings"
 
-	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 )
 
@@ -40,16 +42,53 @@ func (s EncPath) Norm() NormPath {
 	return NormPath(norm.NFC.String(string(s)))
 }
 
+// lookupEncoding returns the character encoding with the IANA name enc, as
+// used for Tag-File-Character-Encoding. UTF-16 without a byte order mark is
+// read as little-endian and written little-endian with a byte order mark.
+func lookupEncoding(enc string) (encoding.Encoding, error) {
+	if strings.EqualFold(enc, `UTF-16`) {
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	}
+	e, err := ianaindex.IANA.Encoding(enc)
+	if err != nil || e == nil {
+		return nil, fmt.Errorf("Unrecognized encoding: %s", enc)
+	}
+	return e, nil
+}
+
+// isUTF8 returns whether enc names UTF-8, which is read and written as is
+func isUTF8(enc string) bool {
+	return strings.EqualFold(enc, `UTF-8`)
+}
+
 func newDecodeReader(reader io.Reader, enc string) (io.Reader, error) {
-	switch strings.ToLower(enc) {
-	case `utf-8`:
+	if isUTF8(enc) {
 		return reader, nil
-	case `utf-16`:
-		dec := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder()
-		return dec.Reader(reader), nil
-	case `iso-8859-1`:
-		dec := charmap.ISO8859_1.NewDecoder()
-		return dec.Reader(reader), nil
 	}
-	return nil, fmt.Errorf("Unrecognized encoding: %s", enc)
+	e, err := lookupEncoding(enc)
+	if err != nil {
+		return nil, err
+	}
+	return e.NewDecoder().Reader(reader), nil
 }
+
+// newEncodeWriter returns a writer that encodes UTF-8 text written to it in
+// enc. Characters that can't be represented in enc are an error. The
+// returned writer must be closed to flush its output, which doesn't close
+// writer.
+func newEncodeWriter(writer io.Writer, enc string) (io.WriteCloser, error) {
+	if isUTF8(enc) {
+		return nopWriteCloser{writer}, nil
+	}
+	e, err := lookupEncoding(enc)
+	if err != nil {
+		return nil, err
+	}
+	return transform.NewWriter(writer, e.NewEncoder()), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,27 @@
+package bago
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDecodeUTF16(t *testing.T) {
+	for name, data := range map[string][]byte{
+		`no BOM`:        {'O', 0, 'k', 0},
+		`little-endian`: {0xff, 0xfe, 'O', 0, 'k', 0},
+		`big-endian`:    {0xfe, 0xff, 0, 'O', 0, 'k'},
+	} {
+		reader, err := newDecodeReader(bytes.NewReader(data), `utf-16`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != `Ok` {
+			t.Errorf("%s: expected Ok, got %q", name, got)
+		}
+	}
+}
@@ -44,3 +44,13 @@ func (f *fetch) parse(reader io.Reader) error {
 	}
 	return nil
 }
+
+func (f fetch) Write(writer io.Writer) error {
+	for _, entry := range f {
+		_, err := fmt.Fprintf(writer, "%s %s %s\n", entry.url, entry.size, entry.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package bago
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity is the level of a validation Finding
+type Severity int
+
+const (
+	Warning Severity = iota // the bag is valid, but may cause problems
+	Error                   // the bag is invalid
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return `error`
+	}
+	return `warning`
+}
+
+// Finding is a problem found while validating a bag
+type Finding struct {
+	Severity Severity
+	Code     string // short identifier for the kind of problem, e.g. payload-oxum-mismatch
+	File     string // the file the finding concerns, if any
+	Message  string
+}
+
+func (f Finding) String() string {
+	if f.File != `` {
+		return fmt.Sprintf("%s: %s: %s", f.Severity, f.File, f.Message)
+	}
+	return fmt.Sprintf("%s: %s", f.Severity, f.Message)
+}
+
+// Findings is a list of validation findings
+type Findings []Finding
+
+func (fs *Findings) add(sev Severity, code string, file string, format string, args ...interface{}) {
+	*fs = append(*fs, Finding{Severity: sev, Code: code, File: file, Message: fmt.Sprintf(format, args...)})
+}
+
+// Errors returns the findings that make the bag invalid
+func (fs Findings) Errors() Findings {
+	return fs.filter(Error)
+}
+
+// Warnings returns the findings that don't make the bag invalid
+func (fs Findings) Warnings() Findings {
+	return fs.filter(Warning)
+}
+
+func (fs Findings) filter(sev Severity) Findings {
+	var ret Findings
+	for _, f := range fs {
+		if f.Severity == sev {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// Err returns an error listing the error findings, or nil if there are none
+func (fs Findings) Err() error {
+	errs := fs.Errors()
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, f := range errs {
+		msgs[i] = f.String()
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+// Findings returns problems with the bag's tag files that can be found
+// without reading the payload. Errors make the bag invalid; warnings don't.
+// For a streamed bag, the checks that need the payload listing or payload
+// manifests (Payload-Oxum and payload manifest consistency) are left out
+// until IsComplete or Validate has read the payload listing.
+func (bag *Bag) Findings() Findings {
+	return append(bag.bagInfoFindings(), bag.manifestFindings()...)
+}
+
+// manifestFindings reports files listed in some payload manifests but not
+// others, and likewise for tag manifests. Tag manifests aren't expected to
+// list each other, so they're left out of the comparison.
+func (bag *Bag) manifestFindings() Findings {
+	var fs Findings
+	report := func(name string, unlisted *pathList) {
+		if unlisted.n > 0 {
+			fs.add(Warning, `inconsistent-manifests`, name,
+				"missing %d files listed in other manifests: %s", unlisted.n, unlisted.String())
+		}
+	}
+	if bag.stream != nil {
+		if bag.stream.walked {
+			for i, name := range bag.stream.manifests {
+				report(name, &bag.stream.unlisted[i])
+			}
+		}
+	} else {
+		for _, u := range unlistedEntries(bag.manifests, nil) {
+			report(u.name, &u.unlisted)
+		}
+	}
+	tagManifests := map[NormPath]bool{}
+	for _, m := range bag.tagManifests {
+		tagManifests[EncodePath(m.Filename()).Norm()] = true
+	}
+	for _, u := range unlistedEntries(bag.tagManifests, tagManifests) {
+		report(u.name, &u.unlisted)
+	}
+	return fs
+}
+
+type unlistedEntry struct {
+	name     string
+	unlisted pathList
+}
+
+// unlistedEntries returns, for each manifest in mans, the paths listed in
+// other manifests in mans but not in it. Paths in skip are ignored.
+func unlistedEntries(mans []*Manifest, skip map[NormPath]bool) []unlistedEntry {
+	if len(mans) < 2 {
+		return nil
+	}
+	all := map[NormPath]bool{}
+	for _, m := range mans {
+		for p := range m.entries {
+			if !skip[p] {
+				all[p] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(all))
+	for p := range all {
+		paths = append(paths, string(p))
+	}
+	sort.Strings(paths)
+	ret := make([]unlistedEntry, len(mans))
+	for i, m := range mans {
+		ret[i].name = m.Filename()
+		for _, p := range paths {
+			if _, ok := m.entries[NormPath(p)]; !ok {
+				ret[i].unlisted.add(p)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,116 @@
+package bago
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+// dropManifestLine removes the lines of a manifest in the bag at dir that
+// end with suffix
+func dropManifestLine(t *testing.T, dir string, name string, suffix string) {
+	file := filepath.Join(dir, name)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if !strings.HasSuffix(strings.TrimSpace(line), suffix) {
+			kept = append(kept, line)
+		}
+	}
+	if err = ioutil.WriteFile(file, []byte(strings.Join(kept, ``)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// inconsistent returns the files of the inconsistent-manifests findings
+func inconsistent(fs Findings) []string {
+	var files []string
+	for _, f := range fs {
+		if f.Code == `inconsistent-manifests` {
+			files = append(files, f.File)
+		}
+	}
+	return files
+}
+
+func TestManifestConsistency(t *testing.T) {
+	for _, streamed := range []bool{false, true} {
+		src := test.TmpDataPath(map[string][]byte{
+			`a.txt`: []byte(`apple`),
+			`b.txt`: []byte(`banana`),
+		})
+		defer os.RemoveAll(src)
+		_, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`, `sha256`}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		open := OpenBag
+		if streamed {
+			open = openStreamed
+		}
+
+		// tag manifests don't list each other, so only bag-info.txt differs
+		dropManifestLine(t, src, `tagmanifest-sha256.txt`, ` bag-info.txt`)
+		{
+			bag, err := open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = bag.Validate(nil); err != nil {
+				t.Errorf("streamed=%v: expected bag to be valid: %s", streamed, err)
+			}
+			files := inconsistent(bag.Findings())
+			if len(files) != 1 || files[0] != `tagmanifest-sha256.txt` {
+				t.Errorf("streamed=%v: expected tagmanifest-sha256.txt to be reported, got %v", streamed, files)
+			}
+		}
+
+		dropManifestLine(t, src, `manifest-sha256.txt`, ` data/b.txt`)
+		for _, alg := range []string{`md5`, `sha256`} {
+			if err = os.Remove(filepath.Join(src, `tagmanifest-`+alg+`.txt`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		{
+			bag, err := open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files := inconsistent(bag.Findings()); streamed && len(files) != 0 {
+				t.Errorf("expected payload manifests of a streamed bag not to be compared before validation, got %v", files)
+			}
+			if err = bag.Validate(nil); err == nil {
+				t.Errorf("streamed=%v: expected validation to fail with a file missing from a manifest", streamed)
+			}
+			if err = bag.Validate(&ValidateOptions{ManifestPolicy: AnyManifest}); err != nil {
+				t.Errorf("streamed=%v: expected bag to be valid with AnyManifest: %s", streamed, err)
+			}
+			findings := bag.Findings()
+			files := inconsistent(findings)
+			if len(files) != 1 || files[0] != `manifest-sha256.txt` {
+				t.Errorf("streamed=%v: expected manifest-sha256.txt to be reported, got %v", streamed, files)
+			} else if !strings.Contains(findings[len(findings)-1].Message, `data/b.txt`) {
+				t.Errorf("streamed=%v: expected data/b.txt in finding: %s", streamed, findings[len(findings)-1])
+			}
+		}
+	}
+}
+
+func TestParseManifestPolicy(t *testing.T) {
+	for _, p := range []ManifestPolicy{AllManifests, AnyManifest} {
+		parsed, err := ParseManifestPolicy(strings.ToUpper(p.String()))
+		if err != nil || parsed != p {
+			t.Errorf("expected %s, got %s (%v)", p, parsed, err)
+		}
+	}
+	if _, err := ParseManifestPolicy(`most`); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
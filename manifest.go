@@ -8,28 +8,124 @@ import (
 	"io"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/srerickson/bago/checksum"
 )
 
+// ManifestKind distinguishes payload manifests from tag manifests
+type ManifestKind int
+
 const (
-	payloadManifest = 0 // default
-	tagManifest     = 1
+	PayloadManifest ManifestKind = iota // default
+	TagManifest
 )
 
+func (k ManifestKind) String() string {
+	if k == TagManifest {
+		return `tag`
+	}
+	return `payload`
+}
+
 //Manifest represents a payload manifest file
 type Manifest struct {
 	algorithm string
 	entries   map[NormPath]ManifestEntry // key is unicode normalized
-	kind      int                        // tag or payload
+	kind      ManifestKind               // tag or payload
 }
 
+// ManifestEntry is a file listed in a manifest and its checksum
 type ManifestEntry struct {
 	path string // raw file system path
 	sum  []byte
 }
 
+// Path returns the entry's path (decoded, not Unicode normalized)
+func (e ManifestEntry) Path() string {
+	return e.path
+}
+
+// Sum returns the entry's checksum
+func (e ManifestEntry) Sum() []byte {
+	return append([]byte(nil), e.sum...)
+}
+
+// HexSum returns the entry's checksum as it appears in a manifest file
+func (e ManifestEntry) HexSum() string {
+	return hex.EncodeToString(e.sum)
+}
+
+// NewManifest returns an empty manifest for the checksum algorithm alg
+func NewManifest(alg string, kind ManifestKind) (*Manifest, error) {
+	alg, err := checksum.NormalizeAlgName(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{algorithm: alg, kind: kind}, nil
+}
+
+// ParseManifest reads a manifest from reader, decoding it from encoding.
+// The algorithm and kind are determined by name, the manifest's filename
+// (e.g. manifest-sha256.txt).
+func ParseManifest(reader io.Reader, name string, encoding string) (*Manifest, error) {
+	man, err := newManifestFromFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	decodeReader, err := newDecodeReader(reader, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if err = man.parse(decodeReader); err != nil {
+		return nil, fmt.Errorf("While parsing %s: %s", name, err.Error())
+	}
+	return man, nil
+}
+
+// Algorithm returns the manifest's checksum algorithm, e.g. sha256
+func (man *Manifest) Algorithm() string {
+	return man.algorithm
+}
+
+// Kind returns whether the manifest is a payload or tag manifest
+func (man *Manifest) Kind() ManifestKind {
+	return man.kind
+}
+
+// Len returns the number of entries in the manifest
+func (man *Manifest) Len() int {
+	return len(man.entries)
+}
+
+// Entries returns the manifest's entries sorted by path, in the order they
+// are written
+func (man *Manifest) Entries() []ManifestEntry {
+	paths := man.sortedPaths()
+	entries := make([]ManifestEntry, len(paths))
+	for i, p := range paths {
+		entries[i] = man.entries[p]
+	}
+	return entries
+}
+
+// Lookup returns the entry for the file path p, which is matched after
+// Unicode normalization
+func (man *Manifest) Lookup(p string) (ManifestEntry, bool) {
+	entry, exists := man.entries[EncodePath(p).Norm()]
+	return entry, exists
+}
+
+func (man *Manifest) sortedPaths() []NormPath {
+	paths := make([]NormPath, 0, len(man.entries))
+	for p := range man.entries {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i] < paths[j] })
+	return paths
+}
+
 // Append adds a new entry to the manifest. It returns an error if the
 // entry already exists. The path is encoded.
 func (man *Manifest) Append(path EncPath, sum []byte) error {
@@ -45,6 +141,14 @@ func (man *Manifest) Append(path EncPath, sum []byte) error {
 }
 
 func (man *Manifest) parse(reader io.Reader) error {
+	return manifestScanner(man.Append).parse(reader)
+}
+
+// manifestScanner is a parser that calls itself with each entry of a
+// manifest instead of storing them
+type manifestScanner func(path EncPath, sum []byte) error
+
+func (add manifestScanner) parse(reader io.Reader) error {
 	manifestLineRE := regexp.MustCompile(`^(\S+)\s+(\S.*)$`)
 	lineNum := 0
 	scanner := bufio.NewScanner(reader)
@@ -63,7 +167,7 @@ func (man *Manifest) parse(reader io.Reader) error {
 		if sum, err = hex.DecodeString(strings.Trim(match[1], ` `)); err != nil {
 			return fmt.Errorf("line %d: %s", lineNum, err.Error())
 		}
-		if err = man.Append(EncPath(cleanEncPath), sum); err != nil {
+		if err = add(EncPath(cleanEncPath), sum); err != nil {
 			return fmt.Errorf("line %d: %s", lineNum, err.Error())
 		}
 	}
@@ -73,8 +177,11 @@ func (man *Manifest) parse(reader io.Reader) error {
 	return nil
 }
 
+// Write writes the manifest with entries sorted by path, so that manifests
+// with the same entries are identical.
 func (man *Manifest) Write(writer io.Writer) error {
-	for _, e := range man.entries {
+	for _, p := range man.sortedPaths() {
+		e := man.entries[p]
 		sum := hex.EncodeToString(e.sum)
 		path := EncodePath(e.path)
 		if _, err := fmt.Fprintf(writer, "%s %s\n", sum, path); err != nil {
@@ -86,7 +193,7 @@ func (man *Manifest) Write(writer io.Writer) error {
 
 // Filename returns filename for the manifest
 func (man *Manifest) Filename() string {
-	if man.kind == tagManifest {
+	if man.kind == TagManifest {
 		return fmt.Sprintf("tagmanifest-%s.txt", man.algorithm)
 	}
 	return fmt.Sprintf("manifest-%s.txt", man.algorithm)
@@ -94,7 +201,7 @@ func (man *Manifest) Filename() string {
 
 // NewManifestFromFilename returns new manifest based on filenme
 func newManifestFromFilename(filename string) (*Manifest, error) {
-	manifestFilenameRE := regexp.MustCompile(`^(tag)?manifest-(\w+).txt$`)
+	manifestFilenameRE := regexp.MustCompile(`^(tag)?manifest-([\w-]+)\.txt$`)
 	match := manifestFilenameRE.FindStringSubmatch(filename)
 	if len(match) < 3 {
 		return nil, fmt.Errorf("Badly formed manifest filename: %s", filename)
@@ -103,11 +210,11 @@ func newManifestFromFilename(filename string) (*Manifest, error) {
 	if err != nil {
 		return nil, err
 	}
-	var kind int
+	var kind ManifestKind
 	if match[1] == `tag` {
-		kind = tagManifest
+		kind = TagManifest
 	} else if match[1] == `` {
-		kind = payloadManifest
+		kind = PayloadManifest
 	} else {
 		return nil, fmt.Errorf("Badly formed manifest filename: %s", filename)
 	}
@@ -1,6 +1,7 @@
 package bago
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -53,3 +54,69 @@ func TestManifestParse(t *testing.T) {
 	}
 
 }
+
+func TestManifestFromFilename(t *testing.T) {
+	tests := map[string]string{
+		`manifest-md5.txt`:           `md5`,
+		`manifest-SHA-256.txt`:       `sha256`,
+		`tagmanifest-sha512-256.txt`: `sha512-256`,
+	}
+	for name, alg := range tests {
+		m, err := newManifestFromFilename(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if m.algorithm != alg {
+			t.Errorf("expected algorithm %s for %s, got %s", alg, name, m.algorithm)
+		}
+	}
+	for _, name := range []string{`manifest-.txt`, `manifest-md5`, `manifest-nope.txt`} {
+		if _, err := newManifestFromFilename(name); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
+
+func TestManifestAPI(t *testing.T) {
+	input := "5678 data/file2\n1234 data/file1\n"
+	man, err := ParseManifest(strings.NewReader(input), `manifest-SHA-256.txt`, `UTF-8`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if man.Algorithm() != `sha256` || man.Kind() != PayloadManifest || man.Len() != 2 {
+		t.Errorf("unexpected manifest: %s %s %d", man.Algorithm(), man.Kind(), man.Len())
+	}
+	entries := man.Entries()
+	if len(entries) != 2 || entries[0].Path() != `data/file1` || entries[1].HexSum() != `5678` {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+	entry, exists := man.Lookup(`data/file1`)
+	if !exists || !bytes.Equal(entry.Sum(), []byte{0x12, 0x34}) {
+		t.Errorf("unexpected entry for data/file1: %v", entry)
+	}
+	if _, exists := man.Lookup(`data/file3`); exists {
+		t.Error("expected no entry for data/file3")
+	}
+	if _, err := ParseManifest(strings.NewReader(input), `manifest.txt`, `UTF-8`); err == nil {
+		t.Error("expected an error for a bad manifest filename")
+	}
+
+	built, err := NewManifest(`MD5`, TagManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Append(EncodePath(`bag-info.txt`), []byte{0xab}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := built.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if built.Filename() != `tagmanifest-md5.txt` || buf.String() != "ab bag-info.txt\n" {
+		t.Errorf("unexpected manifest %s: %q", built.Filename(), buf.String())
+	}
+	if _, err := NewManifest(`nope`, PayloadManifest); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,228 @@
+package bago
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/srerickson/bago/backend"
+)
+
+// metadataTxt is an optional tag file listing file system metadata for the
+// payload, one JSON object per line.
+const metadataTxt = `bago-metadata.jsonl`
+
+// FileMetadata is file system metadata for a payload file or directory,
+// which BagIt manifests don't record
+type FileMetadata struct {
+	Path    string    `json:"path"`           // slash-separated path in the bag, e.g. data/file.txt
+	Type    string    `json:"type"`           // file, dir or link
+	Mode    string    `json:"mode"`           // permission bits, in octal
+	Size    int64     `json:"size,omitempty"` // size of files, in bytes
+	ModTime time.Time `json:"mtime"`
+	UID     int       `json:"uid"` // -1 if unknown
+	GID     int       `json:"gid"` // -1 if unknown
+	Link    string    `json:"link,omitempty"`
+}
+
+// newFileMetadata returns the metadata for the payload path p (relative to
+// data/) from info
+func newFileMetadata(p string, info os.FileInfo) FileMetadata {
+	meta := FileMetadata{
+		Path:    path.Join(dataDir, p),
+		Type:    `file`,
+		Mode:    fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime().UTC(),
+		UID:     -1,
+		GID:     -1,
+	}
+	switch {
+	case info.IsDir():
+		meta.Type = `dir`
+	case info.Mode()&os.ModeSymlink != 0:
+		meta.Type = `link`
+	}
+	if !info.IsDir() {
+		meta.Size = info.Size()
+	}
+	if uid, gid, ok := fileOwner(info); ok {
+		meta.UID, meta.GID = uid, gid
+	}
+	return meta
+}
+
+// planMetadata returns the metadata for the sources of the files and
+// directories in plan
+func planMetadata(plan *PayloadPlan) ([]FileMetadata, error) {
+	var metas []FileMetadata
+	for _, dir := range plan.Dirs {
+		info, err := os.Stat(dir.Src)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, newFileMetadata(dir.Dst, info))
+	}
+	for _, entry := range plan.Entries {
+		stat := os.Stat
+		if entry.Link != `` {
+			stat = os.Lstat
+		}
+		info, err := stat(entry.Src)
+		if err != nil {
+			return nil, err
+		}
+		meta := newFileMetadata(entry.Dst, info)
+		meta.Link = entry.Link
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Path < metas[j].Path
+	})
+	return metas, nil
+}
+
+// metadataList is the contents of the metadata tag file
+type metadataList []FileMetadata
+
+func (metas metadataList) Write(writer io.Writer) error {
+	enc := json.NewEncoder(writer)
+	for _, meta := range metas {
+		if err := enc.Encode(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metadata returns the contents of the bag's metadata tag file, or nil if
+// the bag was created without preserving metadata.
+func (bag *Bag) Metadata() ([]FileMetadata, error) {
+	if _, err := bag.Stat(metadataTxt); err != nil {
+		return nil, nil
+	}
+	reader, err := bag.Open(metadataTxt)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var metas []FileMetadata
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<20)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if strings.TrimSpace(scanner.Text()) == `` {
+			continue
+		}
+		var meta FileMetadata
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", metadataTxt, lineNum, err.Error())
+		}
+		metas = append(metas, meta)
+	}
+	return metas, scanner.Err()
+}
+
+// RestoreOptions is used to pass options to RestoreMetadata()
+type RestoreOptions struct {
+	Dir    string // where the payload was extracted; defaults to the bag's data directory
+	Owners bool   // also restore owners, which usually requires privileges
+}
+
+// RestoreMetadata reapplies the modification times, permissions and,
+// optionally, owners recorded in the bag's metadata tag file to the
+// payload, and recreates empty directories. Files that don't exist are
+// left out.
+func (bag *Bag) RestoreMetadata(opts *RestoreOptions) error {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	metas, err := bag.Metadata()
+	if err != nil {
+		return err
+	}
+	if metas == nil {
+		return fmt.Errorf("bag has no %s", metadataTxt)
+	}
+	dir := opts.Dir
+	if dir == `` {
+		fs, ok := bag.Backend.(*backend.FS)
+		if !ok {
+			return fmt.Errorf("payload directory required for this bag")
+		}
+		dir = filepath.Join(fs.Path, dataDir)
+	}
+	localPath := func(meta FileMetadata) (string, error) {
+		rel := strings.TrimPrefix(path.Clean(meta.Path), dataDir)
+		if rel != `` && !strings.HasPrefix(rel, `/`) {
+			return ``, fmt.Errorf("%s: invalid path: %s", metadataTxt, meta.Path)
+		}
+		return filepath.Join(dir, filepath.FromSlash(rel)), nil
+	}
+	var dirs []FileMetadata
+	for _, meta := range metas {
+		if meta.Type != `dir` {
+			continue
+		}
+		p, err := localPath(meta)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(p, 0755); err != nil {
+			return err
+		}
+		dirs = append(dirs, meta)
+	}
+	for _, meta := range metas {
+		if meta.Type == `dir` {
+			continue
+		}
+		if err := restoreFileMetadata(localPath, meta, opts.Owners); err != nil {
+			return err
+		}
+	}
+	// directories are done last, deepest first, since changing their
+	// contents changes their modification times
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreFileMetadata(localPath, dirs[i], opts.Owners); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreFileMetadata(localPath func(FileMetadata) (string, error), meta FileMetadata, owners bool) error {
+	p, err := localPath(meta)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if owners && meta.UID >= 0 && meta.GID >= 0 {
+		if err = os.Lchown(p, meta.UID, meta.GID); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil // link permissions and times can't be set portably
+	}
+	mode, err := strconv.ParseUint(meta.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("%s: invalid mode for %s: %s", metadataTxt, meta.Path, meta.Mode)
+	}
+	if err = os.Chmod(p, os.FileMode(mode)&os.ModePerm); err != nil {
+		return err
+	}
+	return os.Chtimes(p, meta.ModTime, meta.ModTime)
+}
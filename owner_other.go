@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package bago
+
+import "os"
+
+// fileOwner is not supported on this platform
+func fileOwner(fi os.FileInfo) (uid int, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,148 @@
+package bago
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPattern is a gitignore-style pattern for matching payload paths
+type pathPattern struct {
+	negate  bool // pattern starts with '!'
+	dirOnly bool // pattern ends with '/'
+	re      *regexp.Regexp
+}
+
+// patternList is a list of gitignore-style patterns. As with gitignore, the
+// last pattern matching a path determines whether it matches the list, and
+// paths inside a matching directory match too.
+type patternList []*pathPattern
+
+// compilePatterns compiles gitignore-style patterns:
+//  - '*' matches anything except '/', '?' matches one character except '/'
+//    and '[...]' matches a character class;
+//  - '**' matches any number of directories;
+//  - a pattern with a '/' at the start or middle is matched against the full
+//    path, otherwise it is matched against the path's base name;
+//  - a trailing '/' only matches directories;
+//  - a leading '!' re-includes paths matched by an earlier pattern.
+// Blank patterns and patterns starting with '#' are ignored.
+func compilePatterns(patterns []string) (patternList, error) {
+	var list patternList
+	for _, p := range patterns {
+		if strings.TrimSpace(p) == `` || strings.HasPrefix(p, `#`) {
+			continue
+		}
+		pat, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, pat)
+	}
+	return list, nil
+}
+
+func compilePattern(p string) (*pathPattern, error) {
+	orig := p
+	pat := &pathPattern{}
+	if strings.HasPrefix(p, `!`) {
+		pat.negate = true
+		p = p[1:]
+	}
+	p = strings.TrimRight(p, ` `)
+	if strings.HasSuffix(p, `/`) {
+		pat.dirOnly = true
+		p = strings.TrimRight(p, `/`)
+	}
+	anchored := strings.Contains(p, `/`)
+	p = strings.TrimPrefix(p, `/`)
+	if p == `` {
+		return nil, fmt.Errorf("invalid pattern: %q", orig)
+	}
+	var expr strings.Builder
+	expr.WriteString(`^`)
+	if !anchored {
+		expr.WriteString(`(?:.*/)?`)
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if strings.HasPrefix(p[i:], `**/`) && (i == 0 || p[i-1] == '/') {
+				expr.WriteString(`(?:.*/)?`)
+				i += 2
+			} else if p[i:] == `**` && (i == 0 || p[i-1] == '/') {
+				expr.WriteString(`.*`)
+				i++
+			} else {
+				expr.WriteString(`[^/]*`)
+			}
+		case '?':
+			expr.WriteString(`[^/]`)
+		case '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern: %q", orig)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, `!`) {
+				class = `^` + class[1:]
+			}
+			expr.WriteString(`[` + strings.Replace(class, `\`, `\\`, -1) + `]`)
+			i += end + 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString(`$`)
+	var err error
+	if pat.re, err = regexp.Compile(expr.String()); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %q", orig)
+	}
+	return pat, nil
+}
+
+// matchOne returns whether p matches the slash-separated path, and whether
+// the result of the match is positive.
+func (list patternList) matchOne(p string, isDir bool) (matched bool, result bool) {
+	for i := len(list) - 1; i >= 0; i-- {
+		pat := list[i]
+		if pat.dirOnly && !isDir {
+			continue
+		}
+		if pat.re.MatchString(p) {
+			return true, !pat.negate
+		}
+	}
+	return false, false
+}
+
+// Match returns whether the slash-separated file path p, or one of its
+// parent directories, matches the pattern list.
+func (list patternList) Match(p string) bool {
+	return list.match(p, false)
+}
+
+// MatchDir is like Match for the directory path p
+func (list patternList) MatchDir(p string) bool {
+	return list.match(p, true)
+}
+
+func (list patternList) match(p string, isDir bool) bool {
+	if len(list) == 0 {
+		return false
+	}
+	parts := strings.Split(path.Clean(p), `/`)
+	for i := 1; i < len(parts); i++ {
+		if matched, result := list.matchOne(path.Join(parts[:i]...), true); matched && result {
+			return true
+		}
+	}
+	_, result := list.matchOne(p, isDir)
+	return result
+}
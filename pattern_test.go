@@ -0,0 +1,56 @@
+package bago
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		match    bool
+	}{
+		{[]string{`.DS_Store`}, `.DS_Store`, true},
+		{[]string{`.DS_Store`}, `a/b/.DS_Store`, true},
+		{[]string{`Thumbs.db`}, `a/thumbs.db`, false},
+		{[]string{`*~`}, `dir/file.txt~`, true},
+		{[]string{`*.sw?`}, `dir/.file.swp`, true},
+		{[]string{`*.txt`}, `dir/file.txt.bak`, false},
+		{[]string{`/top.txt`}, `top.txt`, true},
+		{[]string{`/top.txt`}, `dir/top.txt`, false},
+		{[]string{`dir/*.txt`}, `dir/file.txt`, true},
+		{[]string{`dir/*.txt`}, `dir/sub/file.txt`, false},
+		{[]string{`dir/**/*.txt`}, `dir/sub/deeper/file.txt`, true},
+		{[]string{`**/cache`}, `a/b/cache/file`, true},
+		{[]string{`tmp/`}, `a/tmp/file`, true},
+		{[]string{`tmp/`}, `a/tmp`, false},
+		{[]string{`*.log`, `!keep.log`}, `keep.log`, false},
+		{[]string{`*.log`, `!keep.log`}, `other.log`, true},
+		{[]string{`file[0-9].txt`}, `file3.txt`, true},
+		{[]string{`file[!0-9].txt`}, `file3.txt`, false},
+		{[]string{`# comment`, ``}, `# comment`, false},
+	}
+	for _, test := range tests {
+		list, err := compilePatterns(test.patterns)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if list.Match(test.path) != test.match {
+			t.Errorf("expected match of %s with %v to be %v", test.path, test.patterns, test.match)
+		}
+	}
+}
+
+func TestPatternErrors(t *testing.T) {
+	for _, p := range []string{`/`, `!/`, `file[0-9.txt`} {
+		_, err := compilePatterns([]string{p})
+		if err == nil {
+			t.Errorf("expected an error for %q", p)
+		} else if !strings.Contains(err.Error(), strconv.Quote(p)) {
+			t.Errorf("expected the pattern in the error: %s", err)
+		}
+	}
+}
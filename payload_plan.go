@@ -0,0 +1,359 @@
+package bago
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/srerickson/bago/backend"
+)
+
+// PayloadSource is a directory or file to include in a new bag's payload
+type PayloadSource struct {
+	Path   string   // directory or file to include
+	Target string   // slash-separated path under data/; defaults to data/ for directories and the file's name for files
+	Files  []string // if set, only these paths (relative to Path) are included
+}
+
+// PayloadPlan lists the files that will be put in a new bag's payload
+type PayloadPlan struct {
+	Entries   []PlanEntry `json:"entries"`
+	TotalSize int64       `json:"total_size"`
+
+	// Dirs are the source directories walked to find Entries, including
+	// empty ones. They are only planned if metadata is preserved.
+	Dirs []PlanEntry `json:"dirs,omitempty"`
+
+	// Whole is true if the payload is all of a single source directory,
+	// with nothing left out by the walk policy, so that it can be
+	// transferred as a unit.
+	Whole bool `json:"whole"`
+}
+
+// PlanEntry is a file in a PayloadPlan
+type PlanEntry struct {
+	Src  string `json:"src"` // absolute path of the source file
+	Dst  string `json:"dst"` // slash-separated path relative to data/
+	Size int64  `json:"size"`
+
+	// Link is the target of a symbolic link that is preserved in the payload
+	Link string `json:"link,omitempty"`
+}
+
+// PlanPayload returns the payload files for a bag created with opts, without
+// creating the bag. Entries are sorted by destination path.
+func PlanPayload(opts *CreateBagOptions) (*PayloadPlan, error) {
+	include, err := compilePatterns(opts.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	sources := opts.Sources
+	if opts.SrcDir != `` {
+		primary := PayloadSource{Path: opts.SrcDir, Files: opts.Files}
+		sources = append([]PayloadSource{primary}, sources...)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no payload source given")
+	}
+	plan := &PayloadPlan{}
+	whole := len(sources) == 1 && len(sources[0].Files) == 0 &&
+		sources[0].Target == `` && len(include) == 0 && len(exclude) == 0
+	seen := map[NormPath]string{}
+	add := func(src string, dst string, info os.FileInfo) error {
+		if len(include) > 0 && !include.Match(dst) {
+			return nil
+		}
+		if exclude.Match(dst) {
+			return nil
+		}
+		norm := EncodePath(dst).Norm()
+		if prev, exists := seen[norm]; exists {
+			return fmt.Errorf("%s and %s have the same payload path: %s", prev, src, dst)
+		}
+		seen[norm] = src
+		entry := PlanEntry{Src: src, Dst: dst, Size: info.Size()}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if entry.Link, err = os.Readlink(src); err != nil {
+				return err
+			}
+			if info, err = os.Stat(src); err != nil {
+				return err
+			}
+			entry.Size = info.Size()
+		}
+		plan.Entries = append(plan.Entries, entry)
+		plan.TotalSize += entry.Size
+		return nil
+	}
+	var dirs []PlanEntry
+	var addDir func(src, dst string, info os.FileInfo) error
+	if opts.PreserveMetadata {
+		addDir = func(src, dst string, info os.FileInfo) error {
+			if dst == `.` {
+				dst = ``
+			}
+			dirs = append(dirs, PlanEntry{Src: src, Dst: dst})
+			return nil
+		}
+	}
+	for _, source := range sources {
+		if err := source.plan(opts.WalkPolicy, add, addDir); err != nil {
+			return nil, err
+		}
+	}
+	// Transferring a directory as a unit moves every file in it, so it is
+	// only done if the walk policy didn't leave any out.
+	if whole {
+		if plan.Whole, err = plansAll(sources[0].Path, seen); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(plan.Entries, func(i, j int) bool {
+		return plan.Entries[i].Dst < plan.Entries[j].Dst
+	})
+	// keep directories holding payload files, and other directories that
+	// aren't filtered out
+	parents := map[string]bool{}
+	for _, entry := range plan.Entries {
+		for dir := path.Dir(entry.Dst); dir != `.`; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	seenDirs := map[string]bool{}
+	for _, dir := range dirs {
+		if seenDirs[dir.Dst] {
+			continue
+		}
+		if dir.Dst != `` && !parents[dir.Dst] && (exclude.MatchDir(dir.Dst) ||
+			len(include) > 0 && !include.MatchDir(dir.Dst)) {
+			continue
+		}
+		seenDirs[dir.Dst] = true
+		plan.Dirs = append(plan.Dirs, dir)
+	}
+	sort.Slice(plan.Dirs, func(i, j int) bool {
+		return plan.Dirs[i].Dst < plan.Dirs[j].Dst
+	})
+	return plan, nil
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// plansAll returns true if dir only holds directories and the regular files
+// in planned, so that none are left out of the payload if dir is
+// transferred as a unit.
+func plansAll(dir string, planned map[NormPath]string) (bool, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	all := true
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if _, ok := planned[EncodePath(filepath.ToSlash(rel)).Norm()]; !ok || !info.Mode().IsRegular() {
+			all = false
+			return errStopWalk
+		}
+		return nil
+	})
+	if err == errStopWalk {
+		err = nil
+	}
+	return all, err
+}
+
+// plan calls add for each file in the source, and addDir, if it isn't nil,
+// for each directory walked. Directories are walked using policy.
+func (source PayloadSource) plan(policy backend.WalkPolicy, add, addDir func(src, dst string, info os.FileInfo) error) error {
+	root, err := filepath.Abs(source.Path)
+	if err != nil {
+		return err
+	}
+	target := strings.Trim(path.Clean(`/`+filepath.ToSlash(source.Target)), `/`)
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if target == `` {
+			target = filepath.Base(root)
+		}
+		return add(root, target, info)
+	}
+	paths := source.Files
+	if len(paths) == 0 {
+		paths = []string{`.`}
+	}
+	fs := &backend.FS{Path: root, Policy: policy}
+	for _, p := range paths {
+		p = filepath.Clean(filepath.FromSlash(p))
+		if p == `..` || strings.HasPrefix(p, `..`+string(filepath.Separator)) || filepath.IsAbs(p) {
+			return fmt.Errorf("%s is outside of %s", p, root)
+		}
+		if info, err = fs.Stat(p); err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err = add(filepath.Join(root, p), path.Join(target, filepath.ToSlash(p)), info); err != nil {
+				return err
+			}
+			continue
+		}
+		walk := fs.Walk
+		if addDir != nil {
+			walk = fs.WalkAll
+		}
+		err = walk(p, func(rel string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			src, dst := filepath.Join(root, rel), path.Join(target, filepath.ToSlash(rel))
+			if info.IsDir() {
+				return addDir(src, dst, info)
+			}
+			return add(src, dst, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferPlan puts the files in plan in the directory dataPath using mode.
+// It can be called again to resume an interrupted transfer. It returns true
+// if any files were copied (rather than moved or linked), in which case the
+// copies should be verified. In MoveMode, files that can't be renamed
+// because dataPath is on another device are copied; the caller is
+// responsible for removing their sources once the copies are verified.
+func transferPlan(plan *PayloadPlan, dataPath string, mode CreateMode) (copied bool, err error) {
+	for _, entry := range plan.Entries {
+		dst := filepath.Join(dataPath, filepath.FromSlash(entry.Dst))
+		srcInfo, err := os.Lstat(entry.Src)
+		if err != nil {
+			if os.IsNotExist(err) && mode == MoveMode && exists(dst) {
+				continue // already moved
+			}
+			return copied, err
+		}
+		if err = os.RemoveAll(dst); err != nil { // interrupted transfer
+			return copied, err
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return copied, err
+		}
+		if entry.Link != `` {
+			// preserved symbolic link
+			if mode == MoveMode {
+				if err = os.Rename(entry.Src, dst); err == nil {
+					continue
+				}
+				if !isCrossDevice(err) {
+					return copied, err
+				}
+				copied = true
+			}
+			if err = os.Symlink(entry.Link, dst); err != nil {
+				return copied, err
+			}
+			continue
+		}
+		src, entryMode := entry.Src, mode
+		if srcInfo.Mode()&os.ModeSymlink != 0 {
+			// followed symbolic link: transfer its target, leaving the link
+			if src, err = filepath.EvalSymlinks(entry.Src); err != nil {
+				return copied, err
+			}
+			if srcInfo, err = os.Stat(src); err != nil {
+				return copied, err
+			}
+			if mode == MoveMode {
+				entryMode = CopyMode
+			}
+		}
+		if entryMode == MoveMode {
+			if err = os.Rename(src, dst); err == nil {
+				continue
+			}
+			if !isCrossDevice(err) {
+				return copied, err
+			}
+		} else if entryMode == LinkMode {
+			if err = linkFile(src, dst); err == nil {
+				continue
+			}
+			if !cantLink(err) {
+				return copied, err
+			}
+		}
+		copied = true
+		if err = copyFile(src, dst, srcInfo, entryMode == ReflinkMode); err != nil {
+			return copied, err
+		}
+	}
+	for _, dir := range plan.Dirs {
+		if err = os.MkdirAll(filepath.Join(dataPath, filepath.FromSlash(dir.Dst)), 0755); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// removeSources removes the source files in plan that still exist.
+// Followed symbolic links are left in place, as their targets were copied.
+func (plan *PayloadPlan) removeSources() error {
+	for _, entry := range plan.Entries {
+		if entry.Link == `` {
+			if info, err := os.Lstat(entry.Src); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+		}
+		if err := os.Remove(entry.Src); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSources moves files from dataPath back to their sources, where the
+// sources no longer exist.
+func (plan *PayloadPlan) restoreSources(dataPath string) error {
+	for _, entry := range plan.Entries {
+		dst := filepath.Join(dataPath, filepath.FromSlash(entry.Dst))
+		if _, err := os.Lstat(entry.Src); err == nil || !exists(dst) {
+			continue
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(entry.Src), 0755); err != nil {
+			return err
+		}
+		err = os.Rename(dst, entry.Src)
+		if err != nil && isCrossDevice(err) {
+			err = copyFile(dst, entry.Src, info, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package bago
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+func TestPlanPayload(t *testing.T) {
+	src1 := test.TmpDataPath(map[string][]byte{
+		`file1.txt`:      []byte(`this is file 1`),
+		`.DS_Store`:      []byte(`junk`),
+		`dir1/file2.txt`: []byte(`this is file 2`),
+		`dir1/file3.txt`: []byte(`this is file 3`),
+	})
+	defer os.RemoveAll(src1)
+	src2 := test.TmpDataPath(map[string][]byte{
+		`file4.txt`:     []byte(`this is file 4`),
+		`sub/Thumbs.db`: []byte(`junk`),
+	})
+	defer os.RemoveAll(src2)
+	opts := &CreateBagOptions{
+		SrcDir: src1,
+		Files:  []string{`file1.txt`, `.DS_Store`, `dir1`},
+		Sources: []PayloadSource{
+			{Path: src2, Target: `extra`},
+			{Path: filepath.Join(src1, `dir1`, `file3.txt`), Target: `copies/file3.txt`},
+		},
+		Exclude: []string{`.DS_Store`, `Thumbs.db`},
+	}
+	plan, err := PlanPayload(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`copies/file3.txt`,
+		`dir1/file2.txt`,
+		`dir1/file3.txt`,
+		`extra/file4.txt`,
+		`file1.txt`,
+	}
+	if len(plan.Entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), plan.Entries)
+	}
+	for i, entry := range plan.Entries {
+		if entry.Dst != expected[i] {
+			t.Errorf("expected entry %d to be %s, not %s", i, expected[i], entry.Dst)
+		}
+	}
+	if plan.TotalSize != 14*5 {
+		t.Errorf("expected total size %d, not %d", 14*5, plan.TotalSize)
+	}
+	if plan.Whole {
+		t.Error("expected plan not to be whole")
+	}
+
+	// create the bag
+	dst, err := ioutil.TempDir(``, `testBagDst`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	opts.DstPath = filepath.Join(dst, `bag`)
+	opts.Mode = CopyMode
+	opts.Algorithms = []string{`md5`}
+	bag, err := CreateBag(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bag.IsValid(); err != nil {
+		t.Error(err)
+	}
+	if len(bag.payload) != len(expected) {
+		t.Errorf("expected %d payload files, not %d", len(expected), len(bag.payload))
+	}
+
+	// duplicate payload paths
+	opts.Sources = append(opts.Sources, PayloadSource{Path: src2})
+	opts.Sources[0].Target = ``
+	if _, err := PlanPayload(opts); err == nil {
+		t.Error("expected an error for duplicate payload paths")
+	}
+}
@@ -0,0 +1,18 @@
+package bago
+
+import (
+	"os"
+	"syscall"
+)
+
+const ficlone = 0x40049409 // FICLONE ioctl request
+
+// cloneFile makes dst a copy-on-write clone of src, if the filesystem
+// supports it.
+func cloneFile(dst *os.File, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package bago
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not supported on this platform
+func cloneFile(dst *os.File, src *os.File) error {
+	return errors.New("file cloning is not supported")
+}
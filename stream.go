@@ -0,0 +1,533 @@
+package bago
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/srerickson/bago/checksum"
+)
+
+// DefaultStreamThreshold is the total size, in bytes, of a bag's payload
+// manifests above which Hydrate doesn't load the payload manifests or the
+// payload listing into memory, unless Bag.StreamThreshold is set. Such bags
+// are validated by sorting the manifests and the payload listing in
+// temporary files and merging them, so memory use doesn't grow with the
+// number of files. Methods that need the manifests in memory, such as the
+// payload editing methods, load them when called.
+const DefaultStreamThreshold int64 = 128 << 20
+
+// defaultRunSize is the number of records sorted in memory at a time
+const defaultRunSize = 100000
+
+// streamMaxListed is the number of paths listed in completeness errors for
+// streamed bags
+const streamMaxListed = 100
+
+// streamState is set for bags whose payload manifests aren't loaded
+type streamState struct {
+	manifests []string // payload manifest names
+
+	walked bool  // size and count have been set
+	size   int64 // total size of the payload, in bytes
+	count  int64 // number of payload files
+
+	unlisted []pathList // by manifest, paths listed in other manifests but not in it
+
+	runSize int // records sorted in memory at a time; defaults to defaultRunSize
+}
+
+// checkStreaming sets bag.stream if the bag's payload manifests are larger
+// than its stream threshold
+func (bag *Bag) checkStreaming() error {
+	threshold := bag.StreamThreshold
+	if threshold == 0 {
+		threshold = DefaultStreamThreshold
+	}
+	if threshold < 0 {
+		return nil
+	}
+	re := regexp.MustCompile(`^manifest-[\w-]+\.txt$`)
+	var size int64
+	err := bag.walkTags(func(p string, info os.FileInfo, err error) error {
+		if err == nil && re.MatchString(p) {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if size > threshold {
+		bag.stream = &streamState{}
+	}
+	return nil
+}
+
+// loadPayload reads the payload manifests and payload listing of a
+// streamed bag into memory
+func (bag *Bag) loadPayload() error {
+	if bag.stream == nil {
+		return nil
+	}
+	var manifests []*Manifest
+	for _, name := range bag.stream.manifests {
+		man, err := bag.readManifest(name)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, man)
+	}
+	if err := bag.readPayload(); err != nil {
+		return err
+	}
+	bag.manifests = append(manifests, bag.manifests...)
+	bag.stream = nil
+	return nil
+}
+
+// streamFiles are the sorted payload listing and payload manifests of a
+// streamed bag. Records are lines of fields separated by NUL; the first
+// field is the normalized path. Payload records have the quoted path and
+// size, and manifest records have the checksum in hex.
+type streamFiles struct {
+	dir       string
+	payload   string
+	manifests []string // sorted manifest files
+	algs      []string // algorithms of manifests
+	names     []string // names of the bag's manifests
+}
+
+// sortStream writes the sorted payload listing and the named payload
+// manifests to a temporary directory in tmpDir. The caller must call close.
+func (bag *Bag) sortStream(tmpDir string, names []string) (_ *streamFiles, err error) {
+	files := &streamFiles{names: names}
+	if files.dir, err = ioutil.TempDir(tmpDir, `bago-stream`); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			files.close()
+		}
+	}()
+	sorter := &extSorter{dir: files.dir, runSize: bag.stream.runSize}
+	err = bag.Walk(dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 { // preserved link
+			if info, err = bag.Stat(p); err != nil {
+				return err
+			}
+		}
+		norm := EncodePath(p).Norm()
+		return sorter.add(fmt.Sprintf("%s\x00%s\x00%d", norm, strconv.Quote(p), info.Size()))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if files.payload, err = sorter.finish(); err != nil {
+		return nil, err
+	}
+	for _, name := range files.names {
+		man, err := newManifestFromFilename(name)
+		if err != nil {
+			return nil, err
+		}
+		sorter := &extSorter{dir: files.dir, runSize: bag.stream.runSize}
+		err = bag.parse(manifestScanner(func(p EncPath, sum []byte) error {
+			return sorter.add(fmt.Sprintf("%s\x00%x", p.Norm(), sum))
+		}), name, bag.encoding)
+		if err != nil {
+			return nil, err
+		}
+		sorted, err := sorter.finish()
+		if err != nil {
+			return nil, err
+		}
+		files.manifests = append(files.manifests, sorted)
+		files.algs = append(files.algs, man.algorithm)
+	}
+	return files, nil
+}
+
+// walkPayload calls fn with each payload file. The payload listing of a
+// streamed bag is sorted in a temporary directory in tmpDir rather than
+// loaded into memory.
+func (bag *Bag) walkPayload(tmpDir string, fn func(norm NormPath, path string) error) error {
+	if bag.stream == nil {
+		for norm, entry := range bag.payload {
+			if err := fn(norm, entry.path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	files, err := bag.sortStream(tmpDir, nil)
+	if err != nil {
+		return err
+	}
+	defer files.close()
+	return files.merge(func(e *streamEntry) error {
+		return fn(NormPath(e.norm), e.path)
+	})
+}
+
+func (files *streamFiles) close() error {
+	return os.RemoveAll(files.dir)
+}
+
+// streamEntry is a path's records from the sorted payload listing and
+// manifests
+type streamEntry struct {
+	norm    string
+	path    string   // payload path, if in the payload
+	size    int64    // payload file size
+	inData  bool     // the path is in the payload
+	sums    []string // checksums in hex by manifest, empty if not listed
+	listing int      // number of manifests listing the path
+}
+
+// merge calls fn with each path in the sorted files, in order
+func (files *streamFiles) merge(fn func(*streamEntry) error) error {
+	readers := make([]*sortedReader, len(files.manifests)+1)
+	defer func() {
+		for _, r := range readers {
+			if r != nil {
+				r.close()
+			}
+		}
+	}()
+	for i, name := range append([]string{files.payload}, files.manifests...) {
+		var err error
+		if readers[i], err = openSorted(name); err != nil {
+			return err
+		}
+	}
+	for {
+		// the smallest path among the readers
+		key, done := ``, true
+		for _, r := range readers {
+			if !r.done && (done || r.key < key) {
+				key, done = r.key, false
+			}
+		}
+		if done {
+			return nil
+		}
+		entry := &streamEntry{norm: key, sums: make([]string, len(files.manifests))}
+		for i, r := range readers {
+			if r.done || r.key != key {
+				continue
+			}
+			if i == 0 {
+				path, err := strconv.Unquote(r.fields[1])
+				if err != nil {
+					return err
+				}
+				entry.inData, entry.path = true, path
+				if entry.size, err = strconv.ParseInt(r.fields[2], 10, 64); err != nil {
+					return err
+				}
+			} else {
+				entry.sums[i-1] = r.fields[1]
+				entry.listing++
+			}
+			if err := r.next(); err != nil {
+				return err
+			}
+			if !r.done && r.key == key {
+				if i == 0 {
+					return fmt.Errorf("path encoding collision: %s", entry.path)
+				}
+				return fmt.Errorf("While parsing %s: duplicate entry: %s", files.names[i-1], key)
+			}
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// streamComplete checks the completeness of a streamed bag and records the
+// payload totals
+func (b *Bag) streamComplete(files *streamFiles, policy ManifestPolicy) error {
+	var notInPayload, notInManifests pathList
+	var size, count int64
+	unlisted := make([]pathList, len(files.manifests))
+	err := files.merge(func(e *streamEntry) error {
+		if e.listing > 0 && e.listing < len(files.manifests) {
+			for i, sum := range e.sums {
+				if sum == `` {
+					unlisted[i].add(e.norm)
+				}
+			}
+		}
+		if !e.inData {
+			notInPayload.add(e.norm)
+			return nil
+		}
+		size += e.size
+		count++
+		if !policy.satisfied(e.listing, len(files.manifests)) {
+			notInManifests.add(e.norm)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.stream.walked, b.stream.size, b.stream.count = true, size, count
+	b.stream.unlisted = unlisted
+	if notInPayload.n > 0 {
+		return fmt.Errorf("Manifest files missing from payload: %s", notInPayload.String())
+	}
+	if notInManifests.n > 0 {
+		return fmt.Errorf("Payload files missing from manifest: %s", notInManifests.String())
+	}
+	return nil
+}
+
+// streamCheck verifies the checksums of the payload files of a streamed bag
+func (b *Bag) streamCheck(files *streamFiles, opts *ValidateOptions) error {
+	checker := checksum.New(opts.Workers, b.Backend, func(push checksum.JobPusher) error {
+		return files.merge(func(e *streamEntry) error {
+			if !e.inData || e.listing == 0 {
+				return nil
+			}
+			job := checksum.Job{Path: e.path, Expected: map[string][]byte{}}
+			for i, sum := range e.sums {
+				if sum == `` {
+					continue
+				}
+				decoded, err := hex.DecodeString(sum)
+				if err != nil {
+					return err
+				}
+				if _, exists := job.Expected[files.algs[i]]; !exists {
+					job.Algs = append(job.Algs, files.algs[i])
+				}
+				job.Expected[files.algs[i]] = decoded
+			}
+			push(job)
+			return nil
+		})
+	}, opts.checksumOptions()...)
+	var failed pathList
+	for job := range checker.Results() {
+		if !job.SumIsExpected() {
+			if job.Err != nil {
+				failed.add(fmt.Sprintf("'%s' (%s)", job.Path, job.Err.Error()))
+			} else {
+				failed.add(fmt.Sprintf("'%s'", job.Path))
+			}
+		}
+	}
+	if failed.n > 0 {
+		return fmt.Errorf("checksum failed for: %s", failed.String())
+	}
+	return checker.Err()
+}
+
+// validateStream validates a streamed bag, sorting its payload listing and
+// manifests once for both the completeness and checksum checks
+func (b *Bag) validateStream(opts *ValidateOptions) error {
+	files, err := b.sortStream(opts.TempDir, b.stream.manifests)
+	if err != nil {
+		return err
+	}
+	defer files.close()
+	if _, err := b.isComplete(files, opts.ManifestPolicy); err != nil {
+		return fmt.Errorf(`Bag is not complete: %s`, err.Error())
+	}
+	if err := b.Findings().Err(); err != nil {
+		return err
+	}
+	if err = b.streamCheck(files, opts); err != nil {
+		return err
+	}
+	return b.checkManifestJobs(opts) // tag manifests
+}
+
+// pathList collects paths for an error message, keeping only the first
+// streamMaxListed
+type pathList struct {
+	paths []string
+	n     int
+}
+
+func (l *pathList) add(p string) {
+	if l.n++; l.n <= streamMaxListed {
+		l.paths = append(l.paths, p)
+	}
+}
+
+func (l *pathList) String() string {
+	s := strings.Join(l.paths, "\n -")
+	if l.n > len(l.paths) {
+		s += fmt.Sprintf("\n (and %d more)", l.n-len(l.paths))
+	}
+	return s
+}
+
+// extSorter sorts lines of text that may not fit in memory, by sorting
+// runs of runSize lines into temporary files and merging them
+type extSorter struct {
+	dir     string
+	runSize int // defaults to defaultRunSize
+	recs    []string
+	runs    []string
+}
+
+func (s *extSorter) add(rec string) error {
+	s.recs = append(s.recs, rec)
+	runSize := s.runSize
+	if runSize <= 0 {
+		runSize = defaultRunSize
+	}
+	if len(s.recs) >= runSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes the records in memory to a sorted run
+func (s *extSorter) flush() (err error) {
+	sort.Strings(s.recs)
+	file, err := ioutil.TempFile(s.dir, `run`)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, file.Name())
+	writer := bufio.NewWriter(file)
+	for _, rec := range s.recs {
+		writer.WriteString(rec)
+		writer.WriteByte('\n')
+	}
+	s.recs = s.recs[:0]
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// finish merges the runs and returns the name of the sorted file
+func (s *extSorter) finish() (name string, err error) {
+	if len(s.recs) > 0 || len(s.runs) == 0 {
+		if err = s.flush(); err != nil {
+			return ``, err
+		}
+	}
+	if len(s.runs) == 1 {
+		return s.runs[0], nil
+	}
+	out, err := ioutil.TempFile(s.dir, `sorted`)
+	if err != nil {
+		return ``, err
+	}
+	defer out.Close()
+	runs := &runHeap{}
+	defer func() {
+		for _, r := range *runs {
+			r.close()
+		}
+		for _, run := range s.runs {
+			os.Remove(run)
+		}
+	}()
+	for _, run := range s.runs {
+		r, err := openSorted(run)
+		if err != nil {
+			return ``, err
+		}
+		if r.done {
+			r.close()
+			continue
+		}
+		heap.Push(runs, r)
+	}
+	writer := bufio.NewWriter(out)
+	for runs.Len() > 0 {
+		r := (*runs)[0]
+		writer.WriteString(r.line)
+		writer.WriteByte('\n')
+		if err = r.next(); err != nil {
+			return ``, err
+		}
+		if r.done {
+			heap.Pop(runs)
+			r.close()
+		} else {
+			heap.Fix(runs, 0)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return ``, err
+	}
+	return out.Name(), out.Close()
+}
+
+// sortedReader reads records from a sorted file
+type sortedReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    string
+	key     string
+	fields  []string
+	done    bool
+}
+
+func openSorted(name string) (*sortedReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &sortedReader{file: file, scanner: bufio.NewScanner(file)}
+	r.scanner.Buffer(nil, 1<<20)
+	if err = r.next(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *sortedReader) next() error {
+	if !r.scanner.Scan() {
+		r.done = true
+		return r.scanner.Err()
+	}
+	r.line = r.scanner.Text()
+	r.fields = strings.Split(r.line, "\x00")
+	r.key = r.fields[0]
+	if len(r.fields) < 2 {
+		return errors.New("malformed sort record")
+	}
+	return nil
+}
+
+func (r *sortedReader) close() error {
+	return r.file.Close()
+}
+
+// runHeap orders sorted runs by their current line
+type runHeap []*sortedReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortedReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
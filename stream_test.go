@@ -0,0 +1,205 @@
+package bago
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/backend"
+	"github.com/srerickson/bago/test"
+)
+
+// openStreamed opens the bag at path without loading its payload
+// manifests, sorting a few records at a time
+func openStreamed(path string) (*Bag, error) {
+	bag := &Bag{Backend: &backend.FS{Path: path}, StreamThreshold: 1}
+	if err := bag.Hydrate(); err != nil {
+		return nil, err
+	}
+	if bag.stream != nil {
+		bag.stream.runSize = 3
+	}
+	return bag, nil
+}
+
+// walkCounter is an FS that counts the payload paths it reports
+type walkCounter struct {
+	*backend.FS
+	payload int
+}
+
+func (w *walkCounter) count(f filepath.WalkFunc) filepath.WalkFunc {
+	return func(p string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(p, `data`+string(os.PathSeparator)) {
+			w.payload++
+		}
+		return f(p, info, err)
+	}
+}
+
+func (w *walkCounter) Walk(p string, f filepath.WalkFunc) error {
+	return w.FS.Walk(p, w.count(f))
+}
+
+func (w *walkCounter) WalkAll(p string, f filepath.WalkFunc) error {
+	return w.FS.WalkAll(p, w.count(f))
+}
+
+func TestOpenStreamedSkipsPayload(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`a/b.txt`: []byte(`b`),
+		`c/d.txt`: []byte(`d`),
+	})
+	defer os.RemoveAll(src)
+	if _, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}}); err != nil {
+		t.Fatal(err)
+	}
+	be := &walkCounter{FS: &backend.FS{Path: src}}
+	bag := &Bag{Backend: be, StreamThreshold: 1}
+	if err := bag.Hydrate(); err != nil {
+		t.Fatal(err)
+	}
+	if bag.stream == nil || len(bag.stream.manifests) != 1 || len(bag.tagManifests) != 1 {
+		t.Fatal("expected a streamed bag with one payload and one tag manifest")
+	}
+	if be.payload != 0 {
+		t.Errorf("expected the payload not to be walked, got %d paths", be.payload)
+	}
+	mans, err := bag.Manifests()
+	if err != nil || len(mans) != 1 || mans[0].Len() != 2 {
+		t.Fatalf("expected the payload manifest, got %v (%v)", mans, err)
+	}
+	if bag.stream == nil || bag.payload != nil {
+		t.Error("expected the bag to stay streamed")
+	}
+	if err = os.Remove(filepath.Join(src, `manifest-md5.txt`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bag.Manifests(); err == nil {
+		t.Error("expected an error reading a missing manifest")
+	}
+}
+
+func TestExtSorter(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `bago-test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var recs []string
+	sorter := &extSorter{dir: dir, runSize: 3}
+	for i := 0; i < 20; i++ {
+		rec := fmt.Sprintf("%x\x00%d", rand.Int63(), i)
+		recs = append(recs, rec)
+		if err := sorter.add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, err := sorter.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var got []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	sort.Strings(recs)
+	if strings.Join(got, "\n") != strings.Join(recs, "\n") {
+		t.Errorf("expected sorted records, got %q", got)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected runs to be removed, found %d files", len(files))
+	}
+}
+
+func TestStreamValidateFixtures(t *testing.T) {
+	for version, group := range testBags() {
+		for name, path := range group.valid {
+			bag, err := openStreamed(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bag.stream == nil {
+				t.Fatalf("expected bag to be streamed (%s, %s)", version, name)
+			}
+			if err := bag.Validate(nil); err != nil {
+				t.Errorf("Valid test bag should be valid (%s, %s): %s", version, name, err)
+			}
+		}
+		for name, path := range group.invalid {
+			bag, err := openStreamed(path)
+			if err != nil {
+				continue
+			}
+			if err := bag.Validate(nil); err == nil {
+				t.Errorf("Invalid bag should be invalid (%s, %s)", version, name)
+			}
+		}
+	}
+}
+
+func TestStreamValidate(t *testing.T) {
+	fileContent := map[string][]byte{}
+	for _, name := range []string{`a.txt`, `a/b.txt`, `a-b.txt`, `b/c/d.txt`, `é.txt`, `z.txt`} {
+		fileContent[name] = []byte(`content of ` + name)
+	}
+	src := test.TmpDataPath(fileContent)
+	defer os.RemoveAll(src)
+	if _, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`, `sha1`}}); err != nil {
+		t.Fatal(err)
+	}
+	validate := func() error {
+		bag, err := openStreamed(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bag.stream == nil || bag.payload != nil || len(bag.manifests) != 0 {
+			t.Fatal("expected payload manifests not to be loaded")
+		}
+		return bag.Validate(&ValidateOptions{Workers: 2})
+	}
+	if err := validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := filepath.Join(src, `data`, `b`, `c`, `d.txt`)
+	if err := ioutil.WriteFile(corrupt, []byte(`CONTENT OF b/c/d.txt`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(); err == nil || !strings.Contains(err.Error(), `checksum failed`) {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+	if err := os.Remove(corrupt); err != nil {
+		t.Fatal(err)
+	}
+	if err := validate(); err == nil || !strings.Contains(err.Error(), `missing from payload`) {
+		t.Errorf("expected a completeness error, got %v", err)
+	}
+
+	// editing loads the manifests
+	bag, err := openStreamed(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bag.RemovePayload(`b/c/d.txt`); err != nil {
+		t.Fatal(err)
+	}
+	if mans, err := bag.Manifests(); err != nil || bag.stream != nil || len(mans) != 2 {
+		t.Errorf("expected payload manifests to be loaded: %v", err)
+	}
+	if err := validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -10,11 +10,29 @@ import (
 	"unicode/utf8"
 )
 
+// TagSet maps labels to their values
 type TagSet map[string][]string
 
+// TagFile is a tag file such as bag-info.txt. Tags are kept in the order
+// they were parsed or added, and labels are matched case-insensitively.
+// Parsed tags that aren't modified are written exactly as they were read,
+// including line breaks, whitespace and line endings.
 type TagFile struct {
-	tags   TagSet
-	labels []string
+	tags []tagEntry
+	head string // blank lines before the first tag
+	eol  string // line ending for new tags; defaults to "\n"
+}
+
+// tagEntry is a tag and the text it was parsed from
+type tagEntry struct {
+	Tag
+	raw string // empty if the tag is new or modified
+}
+
+// Tag is a label and value in a TagFile
+type Tag struct {
+	Label string
+	Value string
 }
 
 type bagitValues struct {
@@ -30,29 +48,156 @@ func DefaultBagitTxt() *TagFile {
 	return tagFile
 }
 
-func (tf *TagFile) init() {
-	if tf.tags == nil {
-		tf.tags = TagSet{}
+// ParseTagFile reads a tag file from reader, decoding it from encoding
+func ParseTagFile(reader io.Reader, encoding string) (*TagFile, error) {
+	decodeReader, err := newDecodeReader(reader, encoding)
+	if err != nil {
+		return nil, err
 	}
+	tf := &TagFile{}
+	return tf, tf.parse(decodeReader)
 }
 
-func (tf *TagFile) Append(label string, value string) []string {
-	tf.init()
-	if _, ok := tf.tags[label]; !ok {
-		tf.tags[label] = []string{value}
-		tf.labels = append(tf.labels, label)
-	} else {
-		tf.tags[label] = append(tf.tags[label], value)
+// copy returns a copy of tf that doesn't share storage with it
+func (tf *TagFile) copy() TagFile {
+	c := *tf
+	c.tags = append([]tagEntry(nil), tf.tags...)
+	return c
+}
+
+// Len returns the number of tags
+func (tf *TagFile) Len() int {
+	return len(tf.tags)
+}
+
+// Tags returns the tags in order
+func (tf *TagFile) Tags() []Tag {
+	tags := make([]Tag, len(tf.tags))
+	for i := range tf.tags {
+		tags[i] = tf.tags[i].Tag
 	}
-	return tf.tags[label]
+	return tags
+}
+
+// Range calls f for each tag in order, until f returns false
+func (tf *TagFile) Range(f func(label string, value string) bool) {
+	for _, tag := range tf.tags {
+		if !f(tag.Label, tag.Value) {
+			return
+		}
+	}
+}
+
+// Labels returns the distinct labels in the order they first appear
+func (tf *TagFile) Labels() []string {
+	var labels []string
+	for i, tag := range tf.tags {
+		if tf.index(tag.Label) == i {
+			labels = append(labels, tag.Label)
+		}
+	}
+	return labels
+}
+
+// Get returns the values for label, which is matched case-insensitively
+func (tf *TagFile) Get(label string) []string {
+	var vals []string
+	for _, tag := range tf.tags {
+		if strings.EqualFold(tag.Label, label) {
+			vals = append(vals, tag.Value)
+		}
+	}
+	return vals
+}
+
+// Value returns the first value for label, and whether there is one
+func (tf *TagFile) Value(label string) (string, bool) {
+	if i := tf.index(label); i >= 0 {
+		return tf.tags[i].Value, true
+	}
+	return ``, false
+}
+
+// Has returns true if there is a value for label
+func (tf *TagFile) Has(label string) bool {
+	return tf.index(label) >= 0
+}
+
+// TagSet returns the tags as a map. Labels are spelled as they first
+// appear.
+func (tf *TagFile) TagSet() TagSet {
+	set := TagSet{}
+	for _, label := range tf.Labels() {
+		set[label] = tf.Get(label)
+	}
+	return set
+}
+
+// index returns the index of the first tag with label, or -1
+func (tf *TagFile) index(label string) int {
+	for i, tag := range tf.tags {
+		if strings.EqualFold(tag.Label, label) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Append adds a value for label after the existing tags. It returns all
+// values for label.
+func (tf *TagFile) Append(label string, value string) []string {
+	tf.tags = append(tf.tags, tagEntry{Tag: Tag{Label: label, Value: value}})
+	return tf.Get(label)
 }
 
+// Set replaces the values for label with value. The first existing tag with
+// the label keeps its place; otherwise the tag is appended.
 func (tf *TagFile) Set(label string, value string) {
-	tf.init()
-	if _, ok := tf.tags[label]; !ok {
-		tf.labels = append(tf.labels, label)
+	i := tf.index(label)
+	if i < 0 {
+		tf.Append(label, value)
+		return
+	}
+	if tf.tags[i].Label != label || tf.tags[i].Value != value {
+		tf.tags[i] = tagEntry{Tag: Tag{Label: label, Value: value}}
+	}
+	tf.deleteFrom(i+1, label, nil)
+}
+
+// Reformat discards the original formatting of parsed tags, so that every
+// tag is written in the standard format.
+func (tf *TagFile) Reformat() {
+	for i := range tf.tags {
+		tf.tags[i].raw = ``
+	}
+	tf.head, tf.eol = ``, ``
+}
+
+// Delete removes all values for label. It returns false if the label isn't
+// in the tag file.
+func (tf *TagFile) Delete(label string) bool {
+	return tf.deleteFrom(0, label, nil)
+}
+
+// DeleteValue removes the tags with label and value. It returns false if
+// there are none.
+func (tf *TagFile) DeleteValue(label string, value string) bool {
+	return tf.deleteFrom(0, label, &value)
+}
+
+// deleteFrom removes tags with label, and value if it isn't nil, starting
+// at index start
+func (tf *TagFile) deleteFrom(start int, label string, value *string) bool {
+	kept := tf.tags[:start]
+	for _, tag := range tf.tags[start:] {
+		if strings.EqualFold(tag.Label, label) && (value == nil || tag.Value == *value) {
+			continue
+		}
+		kept = append(kept, tag)
 	}
-	tf.tags[label] = []string{value}
+	deleted := len(kept) < len(tf.tags)
+	tf.tags = kept
+	return deleted
 }
 
 func ParseTagFileLine(line string) (ret [2]string, err error) {
@@ -68,36 +213,70 @@ func ParseTagFileLine(line string) (ret [2]string, err error) {
 }
 
 func (tf *TagFile) parse(reader io.Reader) error {
-	tf.tags, tf.labels = nil, nil
+	tf.tags, tf.head, tf.eol = nil, ``, ``
 	lineNum := 0
 	emptyLineRE := regexp.MustCompile(`^\s*$`)
 	contLineRE := regexp.MustCompile(`^\s+\S+`)
 	scanner := bufio.NewScanner(reader)
+	scanner.Split(scanLinesWithEOL)
 	for scanner.Scan() {
 		lineNum++
-		line := scanner.Text()
+		raw := scanner.Text()
+		line := strings.TrimRight(raw, "\r\n")
+		if tf.eol == `` && len(line) < len(raw) {
+			tf.eol = raw[len(line):]
+		}
+		l := len(tf.tags)
 		if emptyLineRE.MatchString(line) {
-			continue // ignore empty lines
+			// empty lines are ignored, but kept for writing
+			if l == 0 {
+				tf.head += raw
+			} else {
+				tf.tags[l-1].raw += raw
+			}
 		} else if contLineRE.MatchString(line) {
 			// continuation of previous label
-			l := len(tf.labels)
 			if l == 0 {
 				return fmt.Errorf("Syntax error at line: %d", lineNum)
 			}
-			prevLabel := tf.labels[l-1]
-			valIndx := len(tf.tags[prevLabel]) - 1
-			tf.tags[prevLabel][valIndx] += " " + strings.Trim(line, ` `)
+			tf.tags[l-1].Value += " " + strings.Trim(line, ` `)
+			tf.tags[l-1].raw += raw
 		} else {
 			// must be start of a new label/value pair.
 			keyVal, err := ParseTagFileLine(line)
 			if err != nil {
 				return fmt.Errorf("Syntax error on line %d: %s", lineNum, err.Error())
 			}
-			tf.Append(keyVal[0], keyVal[1])
+			tf.tags = append(tf.tags, tagEntry{Tag: Tag{Label: keyVal[0], Value: keyVal[1]}, raw: raw})
 		}
+	}
+	return scanner.Err()
+}
 
+// scanLinesWithEOL is a bufio.SplitFunc for lines ending in LF, CRLF or CR,
+// which returns lines with their line endings.
+func scanLinesWithEOL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		switch b {
+		case '\n':
+			return i + 1, data[:i+1], nil
+		case '\r':
+			if i+1 < len(data) {
+				if data[i+1] == '\n' {
+					return i + 2, data[:i+2], nil
+				}
+				return i + 1, data[:i+1], nil
+			}
+			if atEOF {
+				return i + 1, data[:i+1], nil
+			}
+			return 0, nil, nil // need more data to tell CR from CRLF
+		}
 	}
-	return nil
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
 }
 
 // bagitTxtValues validates structure of TagFile from bagit.txt and returns
@@ -109,17 +288,17 @@ func (tf *TagFile) bagitTxtValues() (ret bagitValues, err error) {
 		regexp.MustCompile(`^(\S+)`),
 	}
 	tmpVals := []string{}
-	if len(tf.labels) != len(labels) {
+	if len(tf.Labels()) != len(labels) {
 		err = fmt.Errorf(`%s should have %s and %s`, bagitTxt, labels[0], labels[1])
 		return ret, err
 	}
-	for i, label := range tf.labels {
+	for i, label := range tf.Labels() {
 		if label != labels[i] {
 			err = fmt.Errorf(`Expected %s in line %d of %s to`, label, i, bagitTxt)
 			return ret, err
 		}
-		vals, ok := tf.tags[label]
-		if !ok || len(vals) != 1 {
+		vals := tf.Get(label)
+		if len(vals) != 1 {
 			err = fmt.Errorf(`Expected 1 entry for %s in %s to`, label, bagitTxt)
 			return ret, err
 		}
@@ -139,33 +318,54 @@ func (tf *TagFile) bagitTxtValues() (ret bagitValues, err error) {
 	return ret, nil
 }
 
+// Write writes the tag file. Tags that were parsed and not modified are
+// written as they were read; others are wrapped at 79 columns.
 func (tf *TagFile) Write(writer io.Writer) error {
-	for _, label := range tf.labels {
-		for _, val := range tf.tags[label] {
-			if _, err := fmt.Fprintf(writer, "%s:", label); err != nil {
+	eol := tf.eol
+	if eol == `` {
+		eol = "\n"
+	}
+	if _, err := io.WriteString(writer, tf.head); err != nil {
+		return err
+	}
+	lineEnded := true
+	for _, tag := range tf.tags {
+		if tag.raw != `` {
+			if _, err := io.WriteString(writer, tag.raw); err != nil {
 				return err
 			}
-			runesOnLine := utf8.RuneCountInString(label) + 1
-			scanner := bufio.NewScanner(strings.NewReader(val))
-			scanner.Split(bufio.ScanWords)
-			for scanner.Scan() {
-				word := scanner.Text()
-				len := utf8.RuneCountInString(word)
-				prefix := ``
-				if (runesOnLine + len) < 79 {
-					runesOnLine += (len + 1) // continue on same line
-				} else {
-					prefix = "\n "        // new line: "\n  word"
-					runesOnLine = len + 2 //
-				}
-				if _, err := fmt.Fprintf(writer, "%s %s", prefix, word); err != nil {
-					return err
-				}
+			lineEnded = strings.HasSuffix(tag.raw, "\n") || strings.HasSuffix(tag.raw, "\r")
+			continue
+		}
+		if !lineEnded { // the last parsed line had no line ending
+			if _, err := io.WriteString(writer, eol); err != nil {
+				return err
 			}
-			if _, err := io.WriteString(writer, "\n"); err != nil {
+		}
+		if _, err := fmt.Fprintf(writer, "%s:", tag.Label); err != nil {
+			return err
+		}
+		runesOnLine := utf8.RuneCountInString(tag.Label) + 1
+		scanner := bufio.NewScanner(strings.NewReader(tag.Value))
+		scanner.Split(bufio.ScanWords)
+		for scanner.Scan() {
+			word := scanner.Text()
+			len := utf8.RuneCountInString(word)
+			prefix := ``
+			if (runesOnLine + len) < 79 {
+				runesOnLine += (len + 1) // continue on same line
+			} else {
+				prefix = eol + ` `    // new line: "\n  word"
+				runesOnLine = len + 2 //
+			}
+			if _, err := fmt.Fprintf(writer, "%s %s", prefix, word); err != nil {
 				return err
 			}
 		}
+		if _, err := io.WriteString(writer, eol); err != nil {
+			return err
+		}
+		lineEnded = true
 	}
 	return nil
 }
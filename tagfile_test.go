@@ -1,6 +1,10 @@
 package bago
 
 import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -33,3 +37,119 @@ func TestTagfileParse(t *testing.T) {
 	}
 
 }
+
+func TestTagFileAPI(t *testing.T) {
+	input := "Contact-Name: A\nSource-Organization: Org\ncontact-name: B\nExternal-Description: long\n value\n"
+	tf, err := ParseTagFile(strings.NewReader(input), `UTF-8`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tf.Get(`CONTACT-NAME`); !reflect.DeepEqual(got, []string{`A`, `B`}) {
+		t.Errorf("unexpected values: %v", got)
+	}
+	if got, _ := tf.Value(`external-description`); got != `long value` {
+		t.Errorf("unexpected value: %s", got)
+	}
+	expLabels := []string{`Contact-Name`, `Source-Organization`, `External-Description`}
+	if got := tf.Labels(); !reflect.DeepEqual(got, expLabels) {
+		t.Errorf("unexpected labels: %v", got)
+	}
+	var order []string
+	tf.Range(func(label, value string) bool {
+		order = append(order, value)
+		return len(order) < 3
+	})
+	if !reflect.DeepEqual(order, []string{`A`, `Org`, `B`}) {
+		t.Errorf("unexpected order: %v", order)
+	}
+	if !tf.DeleteValue(`Contact-Name`, `A`) || tf.DeleteValue(`Contact-Name`, `A`) {
+		t.Error("expected DeleteValue to remove a single value once")
+	}
+	if got := tf.Get(`Contact-Name`); !reflect.DeepEqual(got, []string{`B`}) {
+		t.Errorf("unexpected values after DeleteValue: %v", got)
+	}
+	tf.Append(`Contact-Name`, `C`)
+	tf.Set(`Source-Organization`, `Other`)
+	tf.Set(`contact-name`, `D`)
+	expTags := []Tag{
+		{`Source-Organization`, `Other`},
+		{`contact-name`, `D`},
+		{`External-Description`, `long value`},
+	}
+	if got := tf.Tags(); !reflect.DeepEqual(got, expTags) {
+		t.Errorf("unexpected tags: %v", got)
+	}
+	if !tf.Delete(`SOURCE-ORGANIZATION`) || tf.Has(`Source-Organization`) || tf.Len() != 2 {
+		t.Error("expected Delete to remove the tag")
+	}
+	if tf.Delete(`Missing`) {
+		t.Error("expected Delete to return false for a missing tag")
+	}
+}
+
+func TestTagFileRoundTrip(t *testing.T) {
+	inputs := []string{
+		"Field1: Val1\nField1 :  Val2\n",
+		"Field1: Val\n On\n\tSeveral\n  Lines\n\nField2: Val2",
+		"\nField1: Val1\r\nField2:Val2\r\n",
+		"Field1: Val1\rField2: Val2\r",
+	}
+	for _, input := range inputs {
+		tf, err := ParseTagFile(strings.NewReader(input), `UTF-8`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		if err := tf.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != input {
+			t.Errorf("expected %q, got %q", input, out.String())
+		}
+	}
+	// only modified tags are rewritten
+	tf, err := ParseTagFile(strings.NewReader("A :  1\r\nB: two\r\n  lines\r\nC:3"), `UTF-8`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.Set(`A`, `1`) // unchanged
+	tf.Set(`B`, `2`)
+	tf.Append(`D`, `4`)
+	var out strings.Builder
+	if err := tf.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "A :  1\r\nB: 2\r\nC:3\r\nD: 4\r\n"; out.String() != expect {
+		t.Errorf("expected %q, got %q", expect, out.String())
+	}
+	tf.Reformat()
+	out.Reset()
+	if err := tf.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "A: 1\nB: 2\nC: 3\nD: 4\n"; out.String() != expect {
+		t.Errorf("expected %q, got %q", expect, out.String())
+	}
+}
+
+func TestTagFileRoundTripFixtures(t *testing.T) {
+	for _, group := range testBags() {
+		for name, path := range group.valid {
+			bag, err := OpenBag(path)
+			if err != nil || bag.encoding != `UTF-8` {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(path, bagInfo))
+			if err != nil {
+				continue // no bag-info.txt
+			}
+			var out bytes.Buffer
+			if err := bag.Info.Write(&out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("%s: bag-info.txt changed by round trip", name)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package bago
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// CreateMode determines how payload files are transferred into a new bag
+type CreateMode int
+
+const (
+	MoveMode    CreateMode = iota // move the source directory (default)
+	CopyMode                      // copy files, leaving the source intact
+	LinkMode                      // hard link files where possible, otherwise copy
+	ReflinkMode                   // clone files where supported, otherwise copy
+)
+
+var createModeNames = map[CreateMode]string{
+	MoveMode:    `move`,
+	CopyMode:    `copy`,
+	LinkMode:    `link`,
+	ReflinkMode: `reflink`,
+}
+
+func (m CreateMode) String() string {
+	return createModeNames[m]
+}
+
+// ParseCreateMode returns the CreateMode with the given name
+func ParseCreateMode(name string) (CreateMode, error) {
+	for mode, n := range createModeNames {
+		if strings.EqualFold(n, name) {
+			return mode, nil
+		}
+	}
+	return MoveMode, fmt.Errorf("unknown create mode: %s", name)
+}
+
+// transferPayload puts the contents of directory src at dst using mode. It
+// returns true if any files were copied (rather than moved or linked), in
+// which case the copies should be verified. In MoveMode, src is copied if it
+// can't be renamed because dst is on another device; the caller is
+// responsible for removing src once the copy is verified.
+func transferPayload(src string, dst string, mode CreateMode) (copied bool, err error) {
+	if mode == MoveMode {
+		err = os.Rename(src, dst)
+		if err == nil || !isCrossDevice(err) {
+			return false, err
+		}
+		mode = CopyMode // fallback
+	}
+	err = filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if mode == LinkMode {
+			err = linkFile(p, target)
+			if err == nil || !cantLink(err) {
+				return err
+			}
+		}
+		copied = true
+		return copyFile(p, target, info, mode == ReflinkMode)
+	})
+	return copied, err
+}
+
+// copyFile copies src to dst, preserving its permissions and modification
+// time. If clone is true, a copy-on-write clone is attempted first.
+func copyFile(src string, dst string, info os.FileInfo, clone bool) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return err
+	}
+	defer in.Close()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if out, err = os.OpenFile(dst, flags, info.Mode().Perm()); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+		}
+	}()
+	if clone && cloneFile(out, in) == nil {
+		return nil
+	}
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// isCrossDevice returns true if err was caused by an attempt to rename or
+// link a file across devices.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// linkFile creates a hard link; it is replaced by tests
+var linkFile = os.Link
+
+// cantLink returns true if err was caused by an attempt to hard link a file
+// across devices or on a filesystem that doesn't support hard links, in
+// which case the file should be copied instead.
+func cantLink(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.EPERM, syscall.EMLINK, syscall.ENOTSUP, syscall.EOPNOTSUPP} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
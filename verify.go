@@ -0,0 +1,149 @@
+package bago
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/srerickson/bago/checksum"
+)
+
+// VerifyReport lists the differences between a bag's payload and an
+// external manifest. Paths are relative to the bag.
+type VerifyReport struct {
+	Algorithm  string
+	Extra      []string // payload files not in the external manifest
+	Missing    []string // files in the external manifest not in the payload
+	Mismatched []string // files with a different checksum than the external manifest's
+}
+
+// OK returns true if the payload matches the external manifest
+func (r *VerifyReport) OK() bool {
+	return len(r.Extra) == 0 && len(r.Missing) == 0 && len(r.Mismatched) == 0
+}
+
+// bagRelative returns true if every path in man starts with data/, in
+// which case paths in an external manifest are taken to be relative to the
+// bag rather than to data/
+func (man *Manifest) bagRelative() bool {
+	for _, entry := range man.entries {
+		if !strings.HasPrefix(entry.path, dataDir+`/`) {
+			return false
+		}
+	}
+	return len(man.entries) > 0
+}
+
+// RelativeTo says what the paths of an external checksum list are relative to
+type RelativeTo int
+
+const (
+	RelativeGuess     RelativeTo = iota // the bag if every path starts with data/, otherwise data/
+	RelativeToBag                       // the bag
+	RelativeToPayload                   // the payload directory, data/
+)
+
+func (r RelativeTo) String() string {
+	switch r {
+	case RelativeToBag:
+		return `bag`
+	case RelativeToPayload:
+		return `payload`
+	}
+	return `guess`
+}
+
+// ParseRelativeTo parses the name of a RelativeTo: guess, bag or payload
+func ParseRelativeTo(name string) (RelativeTo, error) {
+	switch strings.ToLower(name) {
+	case `guess`:
+		return RelativeGuess, nil
+	case `bag`:
+		return RelativeToBag, nil
+	case `payload`:
+		return RelativeToPayload, nil
+	}
+	return 0, fmt.Errorf("unknown relative-to: %s", name)
+}
+
+// VerifyAgainst compares the bag's payload with external, a manifest from
+// another source such as ParseManifest or ReadChecksums. The bag's own
+// manifests aren't used: payload files listed in external are hashed with
+// its algorithm. Paths in external are relative to the bag or to data/
+// according to opts.RelativeTo, and are Unicode normalized before they are
+// compared. The default guess can't tell a list relative to data/ whose
+// files are all in a directory named data from a list relative to the bag,
+// and takes it to be relative to the bag. The payload listing of a streamed
+// bag is sorted in temporary files in opts.TempDir rather than loaded into
+// memory.
+func (bag *Bag) VerifyAgainst(external *Manifest, opts *ValidateOptions) (*VerifyReport, error) {
+	if opts == nil {
+		opts = &ValidateOptions{}
+	}
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	var prefix string
+	switch opts.RelativeTo {
+	case RelativeToPayload:
+		prefix = dataDir + `/`
+	case RelativeGuess:
+		if !external.bagRelative() {
+			prefix = dataDir + `/`
+		}
+	}
+	report := &VerifyReport{Algorithm: external.algorithm}
+	var jobs []checksum.Job
+	found := map[NormPath]bool{}
+	err := bag.walkPayload(opts.TempDir, func(norm NormPath, p string) error {
+		key := NormPath(strings.TrimPrefix(string(norm), prefix))
+		entry, listed := external.entries[key]
+		if !listed {
+			report.Extra = append(report.Extra, p)
+			return nil
+		}
+		found[key] = true
+		jobs = append(jobs, checksum.Job{
+			Path:     p,
+			Algs:     []string{external.algorithm},
+			Expected: map[string][]byte{external.algorithm: entry.sum},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for norm, entry := range external.entries {
+		if !found[norm] {
+			report.Missing = append(report.Missing, prefix+entry.path)
+		}
+	}
+	checker := checksum.New(opts.Workers, bag.Backend, func(push checksum.JobPusher) error {
+		for _, job := range jobs {
+			push(job)
+		}
+		return nil
+	}, opts.checksumOptions()...)
+	for job := range checker.Results() {
+		if err != nil {
+			continue // drain remaining results
+		}
+		if err = job.Err; err != nil {
+			checker.Cancel()
+			continue
+		}
+		if !job.SumIsExpected() {
+			report.Mismatched = append(report.Mismatched, job.Path)
+		}
+	}
+	if err == nil {
+		err = checker.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(report.Extra)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Mismatched)
+	return report, nil
+}
@@ -0,0 +1,132 @@
+package bago
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/srerickson/bago/test"
+)
+
+func TestVerifyAgainst(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{
+		`hello.txt`:  []byte("hello\n"),
+		`café.txt`:   []byte(`coffee`),
+		`extra.txt`:  []byte(`not listed`),
+		`dir1/a.txt`: []byte(`changed`),
+	})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := strings.Join([]string{
+		`5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  hello.txt`,
+		// decomposed é, matched after normalization
+		"37290d74ac4d186e3a8e5785d259d2ec04fac91ae28092e7620ec8bc99e830aa  cafe\u0301.txt",
+		`0000000000000000000000000000000000000000000000000000000000000000  dir1/a.txt`,
+		`0000000000000000000000000000000000000000000000000000000000000000  missing.txt`,
+	}, "\n")
+	external, err := ReadChecksums(strings.NewReader(list), ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := bag.VerifyAgainst(external[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &VerifyReport{
+		Algorithm:  `sha256`,
+		Extra:      []string{`data/extra.txt`},
+		Missing:    []string{`data/missing.txt`},
+		Mismatched: []string{`data/dir1/a.txt`},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+	if report.OK() {
+		t.Error("expected report not to be OK")
+	}
+	streamed, err := openStreamed(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = streamed.VerifyAgainst(external[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("streamed: expected %+v, got %+v", expected, report)
+	}
+	if streamed.stream == nil || streamed.payload != nil {
+		t.Error("expected the payload not to be loaded")
+	}
+
+	// the bag's own manifest, with paths relative to the bag
+	mans, err := bag.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = bag.VerifyAgainst(mans[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected bag to match its own manifest: %+v", report)
+	}
+}
+
+func TestVerifyRelativeTo(t *testing.T) {
+	// a payload whose files are all in a directory named data
+	src := test.TmpDataPath(map[string][]byte{`data/a.txt`: []byte(`apple`)})
+	defer os.RemoveAll(src)
+	bag, err := CreateBag(&CreateBagOptions{SrcDir: src, InPlace: true, Algorithms: []string{`md5`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := fmt.Sprintf("%x  data/a.txt\n", md5.Sum([]byte(`apple`)))
+	external, err := ReadChecksums(strings.NewReader(list), `md5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := bag.VerifyAgainst(external[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 1 || len(report.Extra) != 1 {
+		t.Errorf("expected the guess to take the list as relative to the bag: %+v", report)
+	}
+	report, err = bag.VerifyAgainst(external[0], &ValidateOptions{RelativeTo: RelativeToPayload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected bag to match a list relative to the payload: %+v", report)
+	}
+	mans, err := bag.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = bag.VerifyAgainst(mans[0], &ValidateOptions{RelativeTo: RelativeToBag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Errorf("expected bag to match its own manifest: %+v", report)
+	}
+}
+
+func TestParseRelativeTo(t *testing.T) {
+	for _, r := range []RelativeTo{RelativeGuess, RelativeToBag, RelativeToPayload} {
+		parsed, err := ParseRelativeTo(strings.ToUpper(r.String()))
+		if err != nil || parsed != r {
+			t.Errorf("expected %s, got %s (%v)", r, parsed, err)
+		}
+	}
+	if _, err := ParseRelativeTo(`data`); err == nil {
+		t.Error("expected an error for an unknown relative-to")
+	}
+}
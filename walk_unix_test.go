@@ -0,0 +1,34 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package bago
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/srerickson/bago/backend"
+	"github.com/srerickson/bago/test"
+)
+
+func TestWalkPolicySpecial(t *testing.T) {
+	src := test.TmpDataPath(map[string][]byte{`file1.txt`: []byte(`this is file 1`)})
+	defer os.RemoveAll(src)
+	if err := syscall.Mkfifo(filepath.Join(src, `fifo`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &CreateBagOptions{SrcDir: src}
+	plan, err := PlanPayload(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Entries) != 1 {
+		t.Errorf("expected fifo to be skipped, got %d entries", len(plan.Entries))
+	}
+	opts.WalkPolicy.Special = backend.SpecialReject
+	if _, err = PlanPayload(opts); err == nil {
+		t.Error("expected an error for a special file")
+	}
+}